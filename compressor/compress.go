@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/klauspost/compress/zstd"
 )
@@ -22,16 +23,28 @@ func CompressDirectory(inputDir, outputFilePath string, compressionLevel int, pr
 	}
 	defer outputFile.Close()
 
+	err = WriteArchive(outputFile, inputDir, compressionLevel, progress)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(inputDir)
+}
+
+// WriteArchive streams a tar archive of inputDir, compressed with zstd, to w.
+// Nothing is written to disk, so w can be an encrypting writer. 'progress'
+// receives the fraction of files archived and is closed at the end.
+func WriteArchive(w io.Writer, inputDir string, compressionLevel int, progress chan<- float64) error {
+	defer close(progress)
+
 	// Create a zstd writer with the specified compression level
-	zstdWriter, err := zstd.NewWriter(outputFile, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compressionLevel)))
+	zstdWriter, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compressionLevel)))
 	if err != nil {
 		return fmt.Errorf("failed to create zstd writer: %w", err)
 	}
-	defer zstdWriter.Close()
 
 	// Create a tar writer
 	tarWriter := tar.NewWriter(zstdWriter)
-	defer tarWriter.Close()
 
 	totalFiles := 0
 	filepath.Walk(inputDir, func(path string, info os.FileInfo, err error) error {
@@ -49,6 +62,11 @@ func CompressDirectory(inputDir, outputFilePath string, compressionLevel int, pr
 			return err
 		}
 
+		// only directories and regular files are archived
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
 		// Create a tar header for the file
 		header, err := tar.FileInfoHeader(info, info.Name())
 		if err != nil {
@@ -60,6 +78,7 @@ func CompressDirectory(inputDir, outputFilePath string, compressionLevel int, pr
 		if err != nil {
 			return err
 		}
+		header.Name = filepath.ToSlash(header.Name)
 
 		// Write the header
 		if err := tarWriter.WriteHeader(header); err != nil {
@@ -85,15 +104,76 @@ func CompressDirectory(inputDir, outputFilePath string, compressionLevel int, pr
 	})
 
 	if err != nil {
+		zstdWriter.Close()
 		return fmt.Errorf("failed to compress directory: %w", err)
 	}
 
-	err = os.RemoveAll(inputDir)
+	if err := tarWriter.Close(); err != nil {
+		zstdWriter.Close()
+		return fmt.Errorf("failed to compress directory: %w", err)
+	}
+
+	return zstdWriter.Close()
+}
+
+// ExtractArchive reads a zstd compressed tar archive, as written by
+// WriteArchive, from r and extracts it in outputDir. Entries pointing outside
+// outputDir are refused.
+func ExtractArchive(r io.Reader, outputDir string) error {
+	// Create a zstd reader
+	zstdReader, err := zstd.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer zstdReader.Close()
+
+	root, err := filepath.Abs(outputDir)
 	if err != nil {
 		return err
 	}
 
-	close(progress)
+	tarReader := tar.NewReader(zstdReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break // End of archive
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the archive: %w", err)
+		}
+
+		// Determine the output path
+		outputPath := filepath.Join(root, filepath.FromSlash(header.Name))
+		if outputPath != root && !strings.HasPrefix(outputPath, root+string(filepath.Separator)) {
+			return fmt.Errorf("illegal path in archive: %s", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// Create directory
+			if err := os.MkdirAll(outputPath, os.ModePerm); err != nil {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(outputPath), os.ModePerm); err != nil {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+			// Create file
+			outputFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return fmt.Errorf("failed to create file: %w", err)
+			}
+
+			_, err = io.Copy(outputFile, tarReader)
+			outputFile.Close()
+			if err != nil {
+				return fmt.Errorf("failed to copy file content: %w", err)
+			}
+		default:
+			return fmt.Errorf("unknown tar header type: %v", header.Typeflag)
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,72 @@
+package encryptor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// DefaultCipher seals the chunks unless GhojiFile.Cipher or Writer.Cipher is
+// set. Headerless files always use AES-256-GCM.
+var DefaultCipher = CipherAES256GCM
+
+// maxOverhead is the largest number of bytes a cipher adds to a chunk.
+const maxOverhead = chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+// ParseCipher returns the cipher called name, as printed by CipherID.String or
+// in lower case. An empty name is DefaultCipher.
+func ParseCipher(name string) (CipherID, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return DefaultCipher, nil
+	case "aes-256-gcm", "aes":
+		return CipherAES256GCM, nil
+	case "chacha20-poly1305", "chacha20":
+		return CipherChaCha20Poly1305, nil
+	case "xchacha20-poly1305", "xchacha20":
+		return CipherXChaCha20Poly1305, nil
+	}
+	return 0, fmt.Errorf("unknown cipher %q, use aes-256-gcm, chacha20-poly1305 or xchacha20-poly1305", name)
+}
+
+// supported tells whether c is a cipher this version can use.
+func (c CipherID) supported() bool {
+	switch c {
+	case CipherAES256GCM, CipherChaCha20Poly1305, CipherXChaCha20Poly1305:
+		return true
+	}
+	return false
+}
+
+// Overhead is the number of bytes a sealed chunk takes on top of its
+// plaintext: the random nonce in front and the tag at the end.
+func (c CipherID) Overhead() int {
+	switch c {
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.NonceSize + chacha20poly1305.Overhead
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+	}
+	return nonceSize + gcmTagSize
+}
+
+// newAEAD returns the AEAD of c keyed with key. It is safe for concurrent use,
+// so a single one serves every chunk of a file.
+func (c CipherID) newAEAD(key [32]byte) (cipher.AEAD, error) {
+	switch c {
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key[:])
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key[:])
+	}
+	return nil, fmt.Errorf("unsupported cipher %s", c)
+}
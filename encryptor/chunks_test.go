@@ -0,0 +1,275 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testPassword = []byte("correct horse battery staple")
+
+// testKDF keeps the key derivations of the tests fast.
+var testKDF = KDFParams{ID: KDFArgon2id, Time: 1, Memory: 1024, Threads: 1}
+
+// testChunks is the number of chunks of the test files.
+const testChunks = 4
+
+func randomData(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// encryptTestFile encrypts testChunks chunks of random data, the last one
+// short, as dir/name.ji and returns its path.
+func encryptTestFile(t *testing.T, dir string, name string) string {
+	t.Helper()
+	plainPath := filepath.Join(dir, name)
+	if err := os.WriteFile(plainPath, randomData(t, (testChunks-1)*MinChunkSize+100), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	x := GhojiFile{
+		FilePath:  plainPath,
+		Password:  testPassword,
+		KDF:       testKDF,
+		ChunkSize: MinChunkSize,
+		Progress:  make(chan float32),
+	}
+	go func() {
+		for range x.Progress {
+		}
+	}()
+	x.Encrypt()
+	if x.Faults != nil {
+		t.Fatalf("unable to encrypt %s: %v", plainPath, x.Faults)
+	}
+	return x.New_filePath
+}
+
+// splitChunks returns the header of the encrypted data and its sealed chunks.
+func splitChunks(t *testing.T, data []byte) ([]byte, [][]byte) {
+	t.Helper()
+	h, err := ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, body := data[:h.Length], data[h.Length:]
+	var chunks [][]byte
+	for len(body) > 0 {
+		n := min(h.EncChunkSize(), len(body))
+		chunks = append(chunks, body[:n])
+		body = body[n:]
+	}
+	return header, chunks
+}
+
+// rewriteChunks replaces the file at path with its header followed by the
+// chunks chosen by edit.
+func rewriteChunks(t *testing.T, path string, edit func(chunks [][]byte) [][]byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, chunks := splitChunks(t, data)
+	if len(chunks) != testChunks {
+		t.Fatalf("%s has %d chunks, want %d", path, len(chunks), testChunks)
+	}
+
+	out := append([]byte{}, header...)
+	for _, c := range edit(chunks) {
+		out = append(out, c...)
+	}
+	if err := os.WriteFile(path, out, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyIntact(t *testing.T) {
+	path := encryptTestFile(t, t.TempDir(), "a")
+	if err := Verify(path, testPassword, nil, nil); err != nil {
+		t.Fatalf("intact file rejected: %v", err)
+	}
+}
+
+func TestChunkTampering(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(chunks [][]byte) [][]byte
+	}{
+		{"reordered", func(c [][]byte) [][]byte {
+			return [][]byte{c[1], c[0], c[2], c[3]}
+		}},
+		{"duplicated", func(c [][]byte) [][]byte {
+			return [][]byte{c[0], c[0], c[2], c[3]}
+		}},
+		{"dropped", func(c [][]byte) [][]byte {
+			return [][]byte{c[0], c[2], c[3]}
+		}},
+		{"truncated at a chunk boundary", func(c [][]byte) [][]byte {
+			return c[:testChunks-1]
+		}},
+		{"flipped bit", func(c [][]byte) [][]byte {
+			c[2][len(c[2])/2] ^= 1
+			return c
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := encryptTestFile(t, t.TempDir(), "a")
+			rewriteChunks(t, path, tt.edit)
+
+			err := Verify(path, testPassword, nil, nil)
+			if !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("Verify = %v, want %v", err, ErrCorrupted)
+			}
+		})
+	}
+}
+
+func TestChunkSpliced(t *testing.T) {
+	dir := t.TempDir()
+	path := encryptTestFile(t, dir, "a")
+	other, err := os.ReadFile(encryptTestFile(t, dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherChunks := splitChunks(t, other)
+
+	// same password, same position, but another file
+	rewriteChunks(t, path, func(c [][]byte) [][]byte {
+		c[1] = otherChunks[1]
+		return c
+	})
+
+	err = Verify(path, testPassword, nil, nil)
+	var chunkErrs *ChunkErrors
+	if !errors.As(err, &chunkErrs) || !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("Verify = %v, want a chunk error", err)
+	}
+}
+
+func TestHeaderTampering(t *testing.T) {
+	// offsets in a version 3 header: magic 0, version 8, length 9, cipher 13,
+	// flags 14, chunk size 15, plain size 19, created 27, slot count 35,
+	// first slot 36. A changed field fails the MAC once the slot is open, a
+	// changed slot cannot be opened at all.
+	tests := []struct {
+		name   string
+		offset int
+		value  byte
+		want   error
+	}{
+		{"chunk size", 15 + 1, 2, ErrCorrupted},
+		{"created", 27 + 7, 0, ErrCorrupted},
+		{"slot data", 36 + 3 + 10, 0, ErrWrongPassword},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := encryptTestFile(t, t.TempDir(), "a")
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data[tt.offset] == tt.value {
+				data[tt.offset]++
+			} else {
+				data[tt.offset] = tt.value
+			}
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			err = Verify(path, testPassword, nil, nil)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// encryptTestStream returns testChunks chunks of random data, the last one
+// short, and their encryption by Writer.
+func encryptTestStream(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	plain := randomData(t, (testChunks-1)*MinChunkSize+100)
+
+	var out bytes.Buffer
+	w := NewWriter(&out, testPassword)
+	w.KDF = testKDF
+	w.ChunkSize = MinChunkSize
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return plain, out.Bytes()
+}
+
+func TestStreamTampering(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(chunks [][]byte) [][]byte
+	}{
+		{"reordered", func(c [][]byte) [][]byte {
+			return [][]byte{c[1], c[0], c[2], c[3]}
+		}},
+		{"dropped", func(c [][]byte) [][]byte {
+			return [][]byte{c[0], c[2], c[3]}
+		}},
+		// without the size in the header, only the final flag of the last
+		// chunk tells that the stream is complete
+		{"truncated at a chunk boundary", func(c [][]byte) [][]byte {
+			return c[:testChunks-1]
+		}},
+		{"final chunk moved up", func(c [][]byte) [][]byte {
+			return [][]byte{c[0], c[3]}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, data := encryptTestStream(t)
+			header, chunks := splitChunks(t, data)
+			if len(chunks) != testChunks {
+				t.Fatalf("the stream has %d chunks, want %d", len(chunks), testChunks)
+			}
+			tampered := append([]byte{}, header...)
+			for _, c := range tt.edit(chunks) {
+				tampered = append(tampered, c...)
+			}
+
+			r := NewReader(bytes.NewReader(tampered), testPassword)
+			defer r.Close()
+			_, err := io.ReadAll(r)
+			if !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("Read = %v, want %v", err, ErrCorrupted)
+			}
+		})
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	plain, data := encryptTestStream(t)
+
+	r := NewReader(bytes.NewReader(data), testPassword)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("the plaintext read back differs from the one written")
+	}
+}
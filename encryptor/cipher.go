@@ -1,78 +1,124 @@
 package encryptor
 
 import (
-	"crypto/aes"
+	"context"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"runtime"
 	"sync"
 )
 
 type Ghojier interface {
-	Rollback()
 	Encrypt()
 	Decrypt()
+	EncryptContext(ctx context.Context)
+	DecryptContext(ctx context.Context)
 }
 
+// GhojiFile encrypts or decrypts the file at FilePath. The output is built
+// under a temporary name and renamed into place only when complete.
 type GhojiFile struct {
-	FilePath     string
+	FilePath string
+	// Output is a file or an existing directory, next to FilePath when empty.
+	Output string
+	// Overwrite replaces an existing output.
+	Overwrite bool
+	// RemoveSource deletes FilePath once the output is synced and in place.
+	RemoveSource bool
+	// Verify decrypts the output again and compares it with the plaintext
+	// before RemoveSource deletes anything.
+	Verify bool
+	// Resume keeps a partial output and a journal of its chunks across
+	// failures, so that the next run with Resume only does the chunks missing.
+	// Files encrypted to Recipients always start over.
+	Resume bool
+	// New_filePath is the path of the output once in place.
 	New_filePath string
-	Password     [32]byte
-	Progress     chan float32
-	Faults       error
+	Password     []byte
+	// Keyfile is the hash of a keyfile (see ReadKeyfile) mixed with Password.
+	Keyfile []byte
+	KDF     KDFParams
+	// ChunkSize is the size of the plaintext chunks written by Encrypt,
+	// DefaultChunkSize when not set. Decrypt uses the one of the header.
+	ChunkSize int
+	// Cipher seals the chunks written by Encrypt, DefaultCipher when not set.
+	Cipher CipherID
+	// Recipients makes Encrypt wrap a random file key for each of them
+	// instead of using Password. Identities open such files.
+	Recipients []*X25519Recipient
+	Identities []*X25519Identity
+	// MaxMemory bounds the buffers of the chunks in flight, the MaxMemory
+	// global when not set.
+	MaxMemory int64
+	Progress  chan float32
+	// Faults is the error of the run. Nothing but a partial output of Resume
+	// is left behind then.
+	Faults error
+	// Partial is the partial output a failed run with Resume left behind.
+	Partial string
 }
 
-// This function encrypts a plain byte list with a 32 byte key. The resulting encrypted buffer
-// will be composed as follow: nonce + enc_buffer + gcmTag
-// So, the resulting buffer length will be 28 bytes longer.
-func encryptBuffer(key [32]byte, buffer []byte) ([]byte, error) {
-	c, err := aes.NewCipher(key[:])
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(c)
-	if err != nil {
-		return nil, err
+// keepPartial records in Partial the partial output of a failed resumable run,
+// left for the next run with Resume.
+func (x *GhojiFile) keepPartial(f *AtomicFile) {
+	if x.Faults != nil {
+		x.Partial = f.Name()
 	}
+}
 
-	nonce := make([]byte, gcm.NonceSize())
+// This function encrypts a plain byte list with the AEAD of the file (see CipherID.newAEAD).
+// The resulting encrypted buffer will be composed as follow: nonce + enc_buffer + tag
+// So, the resulting buffer length will be CipherID.Overhead bytes longer (28 for AES-256-GCM).
+// 'ad' is authenticated but not encrypted, it binds the chunk to its position (see chunkAD).
+// The result is written in 'dst' when it is large enough, a new buffer is allocated otherwise.
+func encryptBuffer(dst []byte, aead cipher.AEAD, buffer []byte, ad []byte) ([]byte, error) {
+	nonce := append(dst[:0], make([]byte, aead.NonceSize())...)
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
 
-	data := gcm.Seal(nil, nonce, buffer, nil)
-
-	data = append(nonce, data...)
-
-	return data, nil
+	return aead.Seal(nonce, nonce, buffer, ad), nil
 }
 
-// This function decrypts a buffer with a 32 byte key. The 'encBuffer'
-// must be composed as follow: nonce + cypherText + gcmTag
-// So, the resulting buffer length will be 28 bytes less.
-func decryptBuffer(key [32]byte, encBuffer []byte) ([]byte, error) {
-	c, err := aes.NewCipher(key[:])
-	if err != nil {
-		return nil, err
+// This function decrypts a buffer with the AEAD of the file. The 'encBuffer'
+// must be composed as follow: nonce + cypherText + tag
+// So, the resulting buffer length will be CipherID.Overhead bytes less.
+// 'ad' must be the same associated data used for the encryption.
+// The result is written in 'dst' when it is large enough, a new buffer is allocated otherwise.
+func decryptBuffer(dst []byte, aead cipher.AEAD, encBuffer []byte, ad []byte) ([]byte, error) {
+	if len(encBuffer) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("chunk too short")
 	}
 
-	gcm, err := cipher.NewGCM(c)
-	if err != nil {
-		return nil, err
-	}
+	nonce := encBuffer[:aead.NonceSize()]
+	buffer := encBuffer[aead.NonceSize():]
+
+	return aead.Open(dst[:0], nonce, buffer, ad)
+}
 
-	nonce := encBuffer[:gcm.NonceSize()]
-	buffer := encBuffer[gcm.NonceSize():]
+// keys is what opens the files to decrypt.
+func (x *GhojiFile) keys() keyring {
+	return keyring{password: x.Password, keyfile: x.Keyfile, identities: x.Identities}
+}
 
-	return gcm.Open(nil, nonce, buffer, nil)
+// interrupted is the fault of an operation on path stopped by its context.
+func interrupted(ctx context.Context, path string) error {
+	return fmt.Errorf("%s: interrupted: %w", path, ctx.Err())
 }
 
+// Encrypt is EncryptContext without a way to stop it.
 func (x *GhojiFile) Encrypt() {
+	x.EncryptContext(context.Background())
+}
+
+// EncryptContext encrypts FilePath as described in GhojiFile. When ctx is
+// cancelled no more chunks are started; once the ones in flight are done the
+// temporary output is removed and Faults wraps ctx.Err().
+func (x *GhojiFile) EncryptContext(ctx context.Context) {
 	runtime.GOMAXPROCS(MaxCPUs)
 	//file opening
 	file, err := os.Open(x.FilePath)
@@ -83,131 +129,179 @@ func (x *GhojiFile) Encrypt() {
 	}
 	defer file.Close()
 
-	filename := filepath.Base(x.FilePath)
-	newFileName := filename + encExt
-	x.New_filePath = filepath.Join(filepath.Dir(x.FilePath), newFileName)
-
-	newFile, err := os.Create(x.New_filePath)
+	//setting up the chunks
+	fileInfo, err := file.Stat()
 	if err != nil {
-		x.Faults = fmt.Errorf("unable to create %s\nerr:%s", x.New_filePath, err)
+		x.Faults = fmt.Errorf("unable to read %s\nerr:%s", x.FilePath, err)
 		close(x.Progress)
 		return
 	}
-	defer newFile.Close()
+	plainChunkSize := x.ChunkSize
+	if plainChunkSize == 0 {
+		plainChunkSize = DefaultChunkSize
+	}
+	if plainChunkSize < MinChunkSize || plainChunkSize > MaxChunkSize {
+		x.Faults = fmt.Errorf("invalid chunk size %d, it must be between %d and %d bytes", plainChunkSize, MinChunkSize, MaxChunkSize)
+		close(x.Progress)
+		return
+	}
+	suite := x.Cipher
+	if suite == 0 {
+		suite = DefaultCipher
+	}
+	if !suite.supported() {
+		x.Faults = fmt.Errorf("unsupported cipher %s", suite)
+		close(x.Progress)
+		return
+	}
+	encChunkSize := plainChunkSize + suite.Overhead()
+	plainSize := int(fileInfo.Size())
+	numChunks := (&Header{PlainSize: uint64(plainSize), ChunkSize: uint32(plainChunkSize)}).NumChunks()
 
-	//setting up the chunks
-	fileInfo, err := file.Stat()
+	newFilePath := ResolveOutput(x.FilePath, x.Output, EncryptedName(x.FilePath))
+	newFile, j, err := x.createOutput(newFilePath, sourceID(journalEncrypt, fileInfo, numChunks, plainChunkSize))
 	if err != nil {
-		x.Faults = fmt.Errorf("unable to read %s\nerr:%s", x.FilePath, err)
+		x.Faults = fmt.Errorf("unable to create %s\nerr:%s", newFilePath, err)
 		close(x.Progress)
 		return
 	}
+	defer newFile.Abort()
+	if j != nil {
+		defer j.close()
+		defer x.keepPartial(newFile)
+	}
 
-	numChunks := int(int(fileInfo.Size()) / chunkSize)
-	lastChunksize := int(fileInfo.Size()) % chunkSize
-
-	//setting the parallelism
-	var wg sync.WaitGroup
-	wg.Add(numChunks) //one for the progress bar
-	if lastChunksize > 0 {
-		wg.Add(1)
+	//a resumed run keeps the header of the partial output, and so its key
+	var header *Header
+	var key [32]byte
+	if j != nil && j.resumed() > 0 && len(x.Recipients) > 0 {
+		j.reset()
+	} else if j != nil && j.resumed() > 0 {
+		header, key, err = resumeHeader(newFile, x.keys(), fileInfo.Size(), plainChunkSize, suite)
+		if errors.Is(err, ErrWrongPassword) {
+			x.Faults = fmt.Errorf("unable to resume %s\nerr:%w", newFilePath, err)
+			close(x.Progress)
+			return
+		}
+		if err != nil {
+			j.reset()
+		}
 	}
 
-	maxGoroutinesChannel := make(chan struct{}, DefaultGoRoutines)
+	fresh := header == nil
+	if fresh && len(x.Recipients) > 0 {
+		//wrapping a random file key for every recipient
+		header, key, err = newRecipientHeader(fileInfo.Size(), plainChunkSize, suite, x.Recipients)
+		if err != nil {
+			x.Faults = fmt.Errorf("unable to wrap the file key\nerr:%s", err)
+			close(x.Progress)
+			return
+		}
+	} else if fresh {
+		//wrapping a random file key with the password
+		header, key, err = newPasswordHeader(fileInfo.Size(), plainChunkSize, suite, x.Password, x.Keyfile, x.KDF)
+		if err != nil {
+			x.Faults = fmt.Errorf("unable to wrap the file key\nerr:%s", err)
+			close(x.Progress)
+			return
+		}
+	}
+	if fresh {
+		header.seal(key)
+		if _, err := newFile.WriteAt(header.Marshal(), 0); err != nil {
+			x.Faults = fmt.Errorf("unable to write the header of %s\nerr:%s", newFilePath, err)
+			close(x.Progress)
+			return
+		}
+		// a partial output started over can be longer than the new one
+		if j != nil {
+			if err := newFile.Truncate(int64(header.Length) + header.BodySize()); err != nil {
+				x.Faults = fmt.Errorf("unable to resize %s\nerr:%s", newFile.Name(), err)
+				close(x.Progress)
+				return
+			}
+		}
+	}
+	aead, err := suite.newAEAD(header.chunkKey(key))
+	if err != nil {
+		x.Faults = fmt.Errorf("unable to set up %s\nerr:%s", suite, err)
+		close(x.Progress)
+		return
+	}
+	if ctx.Err() != nil {
+		x.Faults = interrupted(ctx, x.FilePath)
+		close(x.Progress)
+		return
+	}
+	workers := chunkWorkers(DefaultGoRoutines, x.MaxMemory, plainChunkSize)
 
 	// progress bar
+	var wg sync.WaitGroup
 	counter := make(chan int)
 
 	wg.Add(1)
 	go func() {
 		totalPackets := numChunks
-		if lastChunksize > 0 {
-			totalPackets += 1
-		}
 		sum := 0
 		x.Progress <- 0
 		for plus := range counter {
 			sum += plus
-			if sum == totalPackets {
-				close(counter)
-			}
 			x.Progress <- float32(sum) / float32(totalPackets)
 		}
 		close(x.Progress)
 		wg.Done()
 	}()
 
-	//doing the parallelism
-
-	currentReadOffset := 0
-	currentWriteOffset := 0
-	for i := 0; i < numChunks; i++ {
-		go func(readOffset int, writeOffset int) {
-			maxGoroutinesChannel <- struct{}{}
-			buffer := make([]byte, chunkSize)
-			_, err := file.ReadAt(buffer, int64(readOffset))
-			if err == nil || err == io.EOF {
-				data, err := encryptBuffer(x.Password, buffer)
-				if err == nil {
-					_, err := newFile.WriteAt(data, int64(writeOffset))
-					if err != nil && err != io.EOF {
-						x.Faults = fmt.Errorf("something strange happened when writing at %d of file %s\nerr: %s", readOffset, x.New_filePath, err)
-					}
-				} else {
-					x.Faults = fmt.Errorf("encryption of file %s failed\nerr: %s", x.FilePath, err)
-				}
-
-			} else {
-				x.Faults = fmt.Errorf("something strange happened when reading at %d of file %s\nerr: %s", readOffset, x.FilePath, err)
-			}
-
-			counter <- 1
-			<-maxGoroutinesChannel
-			wg.Done()
-
-		}(currentReadOffset, currentWriteOffset)
-		currentReadOffset += chunkSize
-		currentWriteOffset += enc_chunkSize
-	}
-
-	if lastChunksize > 0 {
-		go func(readOffset int, writeOffset int) {
-			maxGoroutinesChannel <- struct{}{}
-			buffer := make([]byte, lastChunksize)
-			_, err := file.ReadAt(buffer, int64(readOffset))
-			if err == nil || err == io.EOF {
-				data, err := encryptBuffer(x.Password, buffer)
-				if err == nil {
-					_, err = newFile.WriteAt(data, int64(writeOffset))
-					if err != nil && err != io.EOF {
-						x.Faults = fmt.Errorf("something strange happened when writing at %d of file %s\nerr: %s", readOffset, x.New_filePath, err)
-					}
-				} else {
-					x.Faults = fmt.Errorf("encryption of file %s failed\nerr: %s", x.FilePath, err)
-				}
-
-			} else {
-				x.Faults = fmt.Errorf("something strange happened when reading at %d of file %s\nerr: %s", readOffset, x.FilePath, err)
+	//doing the parallelism with a fixed pool of workers, the last chunk can be shorter (or empty)
+	errs := runChunks(ctx, numChunks, workers, plainChunkSize, encChunkSize, func(index int, plain []byte, enc []byte) *ChunkError {
+		readOffset := index * plainChunkSize
+		writeOffset := int(header.Length) + index*encChunkSize
+		buffer := plain[:min(plainChunkSize, plainSize-readOffset)]
+		if j != nil && j.written(newFile, index, int64(writeOffset), len(buffer)+suite.Overhead(), enc) {
+			return nil
+		}
+		_, err := file.ReadAt(buffer, int64(readOffset))
+		if err != nil && err != io.EOF {
+			return &ChunkError{index, int64(readOffset), fmt.Errorf("unable to read\nerr: %s", err)}
+		}
+		data, err := encryptBuffer(enc, aead, buffer, header.chunkAD(index, index == numChunks-1))
+		if err != nil {
+			return &ChunkError{index, int64(readOffset), fmt.Errorf("encryption failed\nerr: %s", err)}
+		}
+		if _, err := newFile.WriteAt(data, int64(writeOffset)); err != nil {
+			return &ChunkError{index, int64(readOffset), fmt.Errorf("unable to write at %d of %s\nerr: %s", writeOffset, newFile.Path(), err)}
+		}
+		if j != nil {
+			if err := j.record(index, data); err != nil {
+				return &ChunkError{index, int64(readOffset), fmt.Errorf("unable to update the journal\nerr: %s", err)}
 			}
-
-			counter <- 1
-			<-maxGoroutinesChannel
-			wg.Done()
-
-		}(currentReadOffset, currentWriteOffset)
+		}
+		return nil
+	}, func() { counter <- 1 })
+	close(counter)
+	x.Faults = newChunkErrors(x.FilePath, errs)
+	if x.Faults == nil && ctx.Err() != nil {
+		x.Faults = interrupted(ctx, x.FilePath)
 	}
 
 	wg.Wait()
-}
 
-func (x *GhojiFile) Rollback() error {
-	if x.New_filePath != "" {
-		return os.Remove(x.New_filePath)
+	if x.Faults != nil {
+		return
+	}
+	x.Faults = x.finish(newFile, x.FilePath, newFile.Name(), keyring{password: x.Password, keyfile: x.Keyfile, fileKey: &key})
+	if x.Faults == nil && j != nil {
+		j.remove()
 	}
-	return nil
 }
 
+// Decrypt is DecryptContext without a way to stop it.
 func (x *GhojiFile) Decrypt() {
+	x.DecryptContext(context.Background())
+}
+
+// DecryptContext is the counterpart of EncryptContext.
+func (x *GhojiFile) DecryptContext(ctx context.Context) {
 	runtime.GOMAXPROCS(MaxCPUs)
 	//file opening
 	file, err := os.Open(x.FilePath)
@@ -218,125 +312,102 @@ func (x *GhojiFile) Decrypt() {
 	}
 	defer file.Close()
 
-	if filepath.Ext(x.FilePath) != encExt {
-		x.Faults = fmt.Errorf("this is not a %s file. I cannot perform a decryption", encExt)
+	//reading the header, files without one use the legacy layout
+	l, err := openLayout(file, x.FilePath, x.keys())
+	if err != nil {
+		x.Faults = err
 		close(x.Progress)
 		return
 	}
-
-	jiFileName := filepath.Base(x.FilePath)
-	filename := jiFileName[:len(jiFileName)-len(encExt)]
-	x.New_filePath = filepath.Join(filepath.Dir(x.FilePath), filename)
-
-	newFile, err := os.Create(x.New_filePath)
-	if err != nil {
-		x.Faults = fmt.Errorf("unable to create %s\nerr:%s", x.New_filePath, err)
+	if ctx.Err() != nil {
+		x.Faults = interrupted(ctx, x.FilePath)
 		close(x.Progress)
 		return
 	}
-	defer newFile.Close()
+	fileInfo, numChunks, plainChunkSize := l.info, l.numChunks, l.plainChunkSize
 
-	//setting up the chunks
-	fileInfo, err := file.Stat()
+	newFilePath := ResolveOutput(x.FilePath, x.Output, DecryptedName(x.FilePath))
+	newFile, j, err := x.createOutput(newFilePath, sourceID(journalDecrypt, fileInfo, numChunks, plainChunkSize))
 	if err != nil {
-		x.Faults = fmt.Errorf("unable to read %s\nerr:%s", x.FilePath, err)
+		x.Faults = fmt.Errorf("unable to create %s\nerr:%s", newFilePath, err)
 		close(x.Progress)
 		return
 	}
-
-	numChunks := int(int(fileInfo.Size()) / enc_chunkSize)
-	lastChunksize := int(fileInfo.Size()) % enc_chunkSize
-
-	//setting the parallelism
-	var wg sync.WaitGroup
-	wg.Add(numChunks) //one for the progress bar
-	if lastChunksize > 0 {
-		wg.Add(1)
+	defer newFile.Abort()
+	if j != nil {
+		defer j.close()
+		defer x.keepPartial(newFile)
 	}
 
-	maxGoroutinesChannel := make(chan struct{}, DefaultGoRoutines)
+	workers := chunkWorkers(DefaultGoRoutines, x.MaxMemory, plainChunkSize)
 
 	// progress bar
+	var wg sync.WaitGroup
 	counter := make(chan int)
 
 	wg.Add(1)
 	go func() {
 		totalPackets := numChunks
-		if lastChunksize > 0 {
-			totalPackets += 1
-		}
 		sum := 0
 		x.Progress <- 0
 		for plus := range counter {
 			sum += plus
-			if sum == totalPackets {
-				close(counter)
-			}
 			x.Progress <- float32(sum) / float32(totalPackets)
 		}
 		close(x.Progress)
 		wg.Done()
 	}()
 
-	//doing the parallelism
-
-	currentReadOffset := 0
-	currentWriteOffset := 0
-	for i := 0; i < numChunks; i++ {
-		go func(readOffset int, writeOffset int) {
-			maxGoroutinesChannel <- struct{}{}
-			buffer := make([]byte, enc_chunkSize)
-			_, err := file.ReadAt(buffer, int64(readOffset))
-			if err == nil || err == io.EOF {
-				data, err := decryptBuffer(x.Password, buffer)
-				if err == nil {
-					_, err := newFile.WriteAt(data, int64(writeOffset))
-					if err != nil && err != io.EOF {
-						x.Faults = fmt.Errorf("something strange happened when writing at %d of file %s\nerr: %s", readOffset, x.New_filePath, err)
-					}
-				} else {
-					x.Faults = fmt.Errorf("decryption of file %s failed\nerr: %s", x.FilePath, err)
-				}
-
-			} else {
-				x.Faults = fmt.Errorf("something strange happened when reading at %d of file %s\nerr: %s", readOffset, x.FilePath, err)
+	//doing the parallelism with a fixed pool of workers, chunks of headerless files carry no associated data
+	errs := runChunks(ctx, numChunks, workers, plainChunkSize, l.encChunkSize, func(index int, plain []byte, enc []byte) *ChunkError {
+		readOffset, size, ad := l.chunk(index)
+		writeOffset := index * plainChunkSize
+		buffer := enc[:size]
+		if j != nil && j.written(newFile, index, int64(writeOffset), len(buffer)-l.overhead, plain) {
+			return nil
+		}
+		_, err := file.ReadAt(buffer, readOffset)
+		if err != nil && err != io.EOF {
+			return &ChunkError{index, readOffset, fmt.Errorf("unable to read\nerr: %s", err)}
+		}
+		data, err := decryptBuffer(plain, l.aead, buffer, ad)
+		if err != nil {
+			return &ChunkError{index, readOffset, fmt.Errorf("%w: %s", ErrCorrupted, err)}
+		}
+		if _, err := newFile.WriteAt(data, int64(writeOffset)); err != nil {
+			return &ChunkError{index, readOffset, fmt.Errorf("unable to write at %d of %s\nerr: %s", writeOffset, newFile.Path(), err)}
+		}
+		if j != nil {
+			if err := j.record(index, data); err != nil {
+				return &ChunkError{index, readOffset, fmt.Errorf("unable to update the journal\nerr: %s", err)}
 			}
-
-			counter <- 1
-			<-maxGoroutinesChannel
-			wg.Done()
-
-		}(currentReadOffset, currentWriteOffset)
-		currentReadOffset += enc_chunkSize
-		currentWriteOffset += chunkSize
+		}
+		return nil
+	}, func() { counter <- 1 })
+	close(counter)
+	x.Faults = newChunkErrors(x.FilePath, errs)
+	if x.Faults == nil && ctx.Err() != nil {
+		x.Faults = interrupted(ctx, x.FilePath)
 	}
 
-	if lastChunksize > 0 {
-		go func(readOffset int, writeOffset int) {
-			maxGoroutinesChannel <- struct{}{}
-			buffer := make([]byte, lastChunksize)
-			_, err := file.ReadAt(buffer, int64(readOffset))
-			if err == nil || err == io.EOF {
-				data, err := decryptBuffer(x.Password, buffer)
-				if err == nil {
-					_, err = newFile.WriteAt(data, int64(writeOffset))
-					if err != nil && err != io.EOF {
-						x.Faults = fmt.Errorf("something strange happened when writing at %d of file %s\nerr: %s", readOffset, x.New_filePath, err)
-					}
-				} else {
-					x.Faults = fmt.Errorf("decryption of file %s failed\nerr: %s", x.FilePath, err)
-				}
-
-			} else {
-				x.Faults = fmt.Errorf("something strange happened when reading at %d of file %s\nerr: %s", readOffset, x.FilePath, err)
-			}
-
-			counter <- 1
-			<-maxGoroutinesChannel
-			wg.Done()
+	wg.Wait()
 
-		}(currentReadOffset, currentWriteOffset)
+	if x.Faults != nil {
+		return
+	}
+	x.Faults = x.finish(newFile, newFile.Name(), x.FilePath, x.keys())
+	if x.Faults == nil && j != nil {
+		j.remove()
 	}
+}
 
-	wg.Wait()
+// createOutput creates the temporary output of a run, or with Resume opens the
+// partial output and the journal left by the previous runs (the journal is nil
+// otherwise).
+func (x *GhojiFile) createOutput(path string, id journalID) (*AtomicFile, *journal, error) {
+	if x.Resume {
+		return createResumable(path, x.FilePath, x.Overwrite, id)
+	}
+	out, err := CreateAtomic(path, x.FilePath, x.Overwrite)
+	return out, nil, err
 }
@@ -0,0 +1,75 @@
+package encryptor
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tempOwner returns the pid of the process that created the temporary file or
+// directory 'name', or false if name is not a ghoji temporary.
+func tempOwner(name string) (int, bool) {
+	if !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, tmpExt) {
+		return 0, false
+	}
+	parts := strings.Split(strings.TrimSuffix(name, tmpExt), ".")
+	if len(parts) < 4 {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(parts[len(parts)-2])
+	if err != nil {
+		return 0, false
+	}
+	return pid, true
+}
+
+// FindOrphans lists the temporary files and directories left in dir by ghoji
+// runs that did not complete (crash, kill, power loss). Temporaries of processes
+// still running are not orphans and are never listed. With recursive the whole
+// tree is searched.
+func FindOrphans(dir string, recursive bool) ([]string, error) {
+	var orphans []string
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+
+		if pid, ok := tempOwner(d.Name()); ok && !processAlive(pid) {
+			orphans = append(orphans, path)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() && !recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	return orphans, err
+}
+
+// RemoveOrphans removes what FindOrphans finds and returns the removed paths.
+func RemoveOrphans(dir string, recursive bool) ([]string, error) {
+	orphans, err := FindOrphans(dir, recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, path := range orphans {
+		if err := os.RemoveAll(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
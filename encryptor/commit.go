@@ -0,0 +1,244 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// tmpExt ends the name of the hidden files and directories an output is
+// written to before it gets its real name. The full name is
+// .<final name>.<pid>.<random>.ghoji-tmp, the pid tells whether the process that
+// created it is still running (see FindOrphans).
+const tmpExt = ".ghoji-tmp"
+
+var ErrVerifyFailed = errors.New("verification failed: the output does not match the input")
+
+func tempPattern(path string) string {
+	return fmt.Sprintf(".%s.%d.*%s", filepath.Base(path), os.Getpid(), tmpExt)
+}
+
+// createTemp creates the hidden temporary file, next to 'path', where the
+// output is written.
+func createTemp(path string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(path), tempPattern(path))
+}
+
+// CreateTempDir creates the hidden temporary directory, next to 'path', where a
+// directory output is built before being moved into place with CommitDir.
+func CreateTempDir(path string) (string, error) {
+	return os.MkdirTemp(filepath.Dir(path), tempPattern(path))
+}
+
+// CommitDir moves the temporary directory tmp to path. With overwrite an
+// existing path is removed first, otherwise it is refused.
+func CommitDir(tmp string, path string, overwrite bool) error {
+	if _, err := os.Stat(path); err == nil {
+		if !overwrite {
+			return fmt.Errorf("%s: %w", path, ErrOutputExists)
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// AtomicFile is an output written to a hidden temporary file and moved to its
+// final path by Commit. Until then (or after a crash) nothing exists under the
+// final name. With keep, the partial output of a resumable run, the temporary
+// file is never removed.
+type AtomicFile struct {
+	*os.File
+	path      string
+	overwrite bool
+	keep      bool
+	done      bool
+}
+
+// CreateAtomic creates the temporary file of the output 'path', checked with
+// CheckOutput against the input.
+func CreateAtomic(path string, input string, overwrite bool) (*AtomicFile, error) {
+	if err := CheckOutput(path, input, overwrite); err != nil {
+		return nil, err
+	}
+	file, err := createTemp(path)
+	if err != nil {
+		return nil, err
+	}
+	return &AtomicFile{File: file, path: path, overwrite: overwrite}, nil
+}
+
+// Path is the final path of the file.
+func (f *AtomicFile) Path() string {
+	return f.path
+}
+
+// Commit syncs the file and renames it to its final path.
+func (f *AtomicFile) Commit() error {
+	if f.done {
+		return fmt.Errorf("%s already committed or aborted", f.path)
+	}
+	f.done = true
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		f.remove()
+		return fmt.Errorf("unable to sync %s\nerr:%s", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		f.remove()
+		return fmt.Errorf("unable to close %s\nerr:%s", f.Name(), err)
+	}
+	if err := commitOutput(f.Name(), f.path, f.overwrite); err != nil {
+		f.remove()
+		return err
+	}
+	return nil
+}
+
+// Abort removes the temporary file. It does nothing after Commit, so it can
+// always be deferred.
+func (f *AtomicFile) Abort() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	f.Close()
+	return f.remove()
+}
+
+// remove deletes the temporary file, unless it is kept.
+func (f *AtomicFile) remove() error {
+	if f.keep {
+		return nil
+	}
+	return os.Remove(f.Name())
+}
+
+// commitOutput gives the temporary file its final name 'path' with an atomic
+// rename, then syncs the directory so that the rename survives a crash. The
+// file must be already synced and closed. Without overwrite, an existing file
+// at path is never replaced (even one created in the meantime).
+func commitOutput(tmpPath string, path string, overwrite bool) error {
+	if overwrite {
+		if err := os.Rename(tmpPath, path); err != nil {
+			return err
+		}
+	} else {
+		// a hard link fails if path exists, unlike rename
+		err := os.Link(tmpPath, path)
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s: %w", path, ErrOutputExists)
+		}
+		if err != nil {
+			// file systems without hard links
+			if _, serr := os.Stat(path); serr == nil {
+				return fmt.Errorf("%s: %w", path, ErrOutputExists)
+			}
+			if err := os.Rename(tmpPath, path); err != nil {
+				return err
+			}
+		} else {
+			os.Remove(tmpPath)
+		}
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the directory entry changes to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// not every platform can sync a directory, the rename is done anyway
+	d.Sync()
+	return nil
+}
+
+func hashReader(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyOutput decrypts the file at encPath again, opened with keys, and
+// compares its hash with the one of the plaintext at plainPath. It is run
+// before removing the source of an encryption or a decryption.
+func verifyOutput(plainPath string, encPath string, keys keyring) error {
+	plain, err := os.Open(plainPath)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+
+	enc, err := os.Open(encPath)
+	if err != nil {
+		return err
+	}
+	defer enc.Close()
+
+	plainHash, err := hashReader(plain)
+	if err != nil {
+		return err
+	}
+
+	r := NewReader(enc, keys.password)
+	r.Identities = keys.identities
+	r.Keyfile = keys.keyfile
+	r.fileKey = keys.fileKey
+	defer r.Close()
+	decHash, err := hashReader(r)
+	if err != nil {
+		return fmt.Errorf("%w\nerr: %s", ErrVerifyFailed, err)
+	}
+
+	if !bytes.Equal(plainHash, decHash) {
+		return ErrVerifyFailed
+	}
+	return nil
+}
+
+// finish completes an encryption or decryption whose output has been written
+// in 'out': optional verification with keys, sync and atomic rename to the
+// final path, and finally the removal of the source if requested. The source
+// is never removed unless the output is safely in place.
+func (x *GhojiFile) finish(out *AtomicFile, plainPath string, encPath string, keys keyring) error {
+	// the temporary file is private, the output gets the permissions of the source
+	if info, err := os.Stat(x.FilePath); err == nil {
+		out.Chmod(info.Mode().Perm())
+	}
+
+	if x.Verify {
+		if err := verifyOutput(plainPath, encPath, keys); err != nil {
+			return err
+		}
+	}
+
+	if err := out.Commit(); err != nil {
+		return fmt.Errorf("unable to move the output to %s\nerr:%s", out.Path(), err)
+	}
+	x.New_filePath = out.Path()
+
+	if x.RemoveSource {
+		if err := os.Remove(x.FilePath); err != nil {
+			return fmt.Errorf("%s is in place but the source could not be removed\nerr:%s", out.Path(), err)
+		}
+		syncDir(filepath.Dir(x.FilePath))
+	}
+
+	return nil
+}
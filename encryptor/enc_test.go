@@ -0,0 +1,30 @@
+package encryptor
+
+import "testing"
+
+func TestFilesInFlight(t *testing.T) {
+	const mib = 1024 * 1024
+	tests := []struct {
+		name      string
+		maxfiles  int
+		maxMemory int64
+		plainSize int
+		want      int
+	}{
+		{"within the budget", 4, 512 * mib, mib, 4},
+		{"more files than the budget", 1000, 512 * mib, mib, int(512 * mib / chunkCost(mib))},
+		{"budget below one chunk", 8, mib, MaxChunkSize, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filesInFlight(tt.maxfiles, tt.maxMemory, tt.plainSize)
+			if got != tt.want {
+				t.Fatalf("filesInFlight = %d, want %d", got, tt.want)
+			}
+			if got > 1 && int64(got)*chunkCost(tt.plainSize) > tt.maxMemory {
+				t.Fatalf("%d files of one chunk take %d bytes, more than %d", got, int64(got)*chunkCost(tt.plainSize), tt.maxMemory)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package encryptor
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ChunkError is the failure of a single chunk. Offset is the position of the
+// chunk in the file being read: the plaintext when encrypting, the .ji file
+// when decrypting.
+type ChunkError struct {
+	Index  int
+	Offset int64
+	Err    error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d at offset %d: %s", e.Index, e.Offset, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// ChunkErrors gathers the chunks of Path that failed, sorted by index. It is
+// what GhojiFile.Faults holds when the processing of the chunks went wrong;
+// errors.Is and errors.As look through every chunk error.
+type ChunkErrors struct {
+	Path   string
+	Errors []*ChunkError
+}
+
+func (e *ChunkErrors) Error() string {
+	first := e.Errors[0]
+	if len(e.Errors) == 1 {
+		return fmt.Sprintf("%s failed at %s", e.Path, first)
+	}
+	return fmt.Sprintf("%s failed at %d chunks, the first is %s", e.Path, len(e.Errors), first)
+}
+
+func (e *ChunkErrors) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// newChunkErrors returns nil when there is no error, so that the result can be
+// assigned to an error without getting a non-nil interface.
+func newChunkErrors(path string, errs []*ChunkError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Index < errs[j].Index })
+	return &ChunkErrors{Path: path, Errors: errs}
+}
@@ -8,7 +8,29 @@ const gcmTagSize = 16
 const chunkSize = 1024 * 1024 * 1
 const enc_chunkSize = chunkSize + nonceSize + gcmTagSize
 
+// Bounds of the chunk size recorded in the header. chunkSize is the default,
+// and the only size of the headerless files.
+const MinChunkSize = 64 * 1024
+const MaxChunkSize = 64 * 1024 * 1024
+const DefaultChunkSize = chunkSize
+
+// formatVersion is the latest version of the header, every version from
+// minFormatVersion can be read. Version 2 adds the creation time, version 3
+// a random file key wrapped in slots, for each recipient or password.
+const formatVersion = 3
+const minFormatVersion = 1
+const maxHeaderSize = 64 * 1024
+
 var DefaultGoRoutines = 100
 var DefaultMaxFiles = 10
 
+// MaxMemory is the budget, in bytes, for the chunk buffers of an operation (a
+// file, a stream or a whole directory). It limits the chunks in flight.
+var MaxMemory int64 = 512 * 1024 * 1024
+
+// MaxKDFMemory is the budget, in bytes, of the memory-hard key derivations
+// running at once, on top of MaxMemory: the files processed in parallel wait
+// for their turn to derive a key. A derivation needing more runs alone.
+var MaxKDFMemory int64 = 256 * 1024 * 1024
+
 var MaxCPUs = runtime.NumCPU()
@@ -0,0 +1,534 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// magic opens every .ji file written with a header. Files that do not start
+// with it are treated as legacy (headerless) archives.
+const magic = "\x89GHOJI\r\n"
+
+// preambleSize is the part of the header every version shares:
+// magic + version + total header length.
+const preambleSize = len(magic) + 1 + 4
+
+const headerMACSize = sha256.Size
+
+// headerMACLabel and chunkLabel separate the subkeys derived from the file key
+// from version 3 on: one authenticates the header, the other seals the chunks.
+const (
+	headerMACLabel = "ghoji/v3/header-mac"
+	chunkLabel     = "ghoji/v3/chunk"
+)
+
+// CipherID identifies the AEAD used to seal the chunks (see aead.go).
+type CipherID uint8
+
+const (
+	CipherAES256GCM CipherID = 1
+	// CipherChaCha20Poly1305 is faster than AES-256-GCM on CPUs without AES
+	// instructions, with the same 96-bit random nonces.
+	CipherChaCha20Poly1305 CipherID = 2
+	// CipherXChaCha20Poly1305 has 192-bit nonces, which can be drawn at random
+	// for any amount of data under one key.
+	CipherXChaCha20Poly1305 CipherID = 3
+)
+
+// KDFID identifies how the chunk key is obtained from the password.
+type KDFID uint8
+
+const (
+	// KDFSHA256 is a single unsalted sha256 of the password, the scheme used by
+	// the headerless format.
+	KDFSHA256   KDFID = 1
+	KDFArgon2id KDFID = 2
+	KDFScrypt   KDFID = 3
+)
+
+// Header flags
+const (
+	// FlagStream marks files written by Writer: PlainSize is unknown and the
+	// end of the data is given by the final chunk only.
+	FlagStream uint8 = 1 << 0
+	// FlagArchive marks a payload that is a zstd compressed tar of a directory
+	// (see compressor.WriteArchive) rather than a single file.
+	FlagArchive uint8 = 1 << 1
+)
+
+// SlotType identifies how a slot of a version 3 header wraps the file key.
+type SlotType uint8
+
+const (
+	// SlotX25519 wraps the file key for an X25519 public key (see
+	// X25519Recipient).
+	SlotX25519 SlotType = 1
+	// SlotPassword wraps the file key with a key derived from a password (see
+	// passwordSlot).
+	SlotPassword SlotType = 2
+	// SlotKeyfile is a SlotPassword whose key is derived from a password mixed
+	// with a keyfile (see mixKeyfile). The password can be empty.
+	SlotKeyfile SlotType = 3
+)
+
+// Slot is a copy of the file key wrapped for one recipient or password. Data
+// is opaque to the header, see X25519Recipient and passwordSlot for its
+// layout.
+type Slot struct {
+	Type SlotType
+	Data []byte
+}
+
+// maxSlots bounds the slots of a header, whose count is stored in a byte.
+const maxSlots = 255
+
+// headerBlock is the unit of the length of version 3 headers: the space left
+// after the MAC is zero padding, so that slots can be changed without moving
+// the chunks.
+const headerBlock = 4096
+
+var (
+	ErrNoHeader           = errors.New("no ghoji header found")
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+	ErrWrongPassword      = errors.New("wrong password or corrupted header")
+	ErrCorrupted          = errors.New("file is corrupted")
+	ErrNoIdentity         = errors.New("none of the identities is a recipient of the file")
+	// ErrAborted is the error of a Writer stopped by CloseWithError(nil).
+	ErrAborted = errors.New("encryption aborted, the output is incomplete")
+)
+
+func (c CipherID) String() string {
+	switch c {
+	case CipherAES256GCM:
+		return "AES-256-GCM"
+	case CipherChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	case CipherXChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+func (s SlotType) String() string {
+	switch s {
+	case SlotX25519:
+		return "x25519"
+	case SlotPassword:
+		return "password"
+	case SlotKeyfile:
+		return "keyfile"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+func (k KDFID) String() string {
+	switch k {
+	case KDFSHA256:
+		return "sha256"
+	case KDFArgon2id:
+		return "argon2id"
+	case KDFScrypt:
+		return "scrypt"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(k))
+}
+
+// Header is the self-describing preamble of a .ji file. It is written in front
+// of the first chunk and must be parsed and authenticated before any chunk is
+// decrypted. Length is the offset of the first chunk. Created, in Unix seconds,
+// is only stored from version 2 on.
+// Up to version 2 the chunk key is derived from the password with KDF. From
+// version 3 it is a random file key, wrapped in Slots for each recipient or
+// password, and KDF is unused; the file key is not used as is, the keys of the
+// header MAC and of the chunks are derived from it (see subkey).
+type Header struct {
+	Version   uint8
+	Length    uint32
+	Cipher    CipherID
+	Flags     uint8
+	ChunkSize uint32
+	PlainSize uint64
+	Created   int64
+	KDF       KDFParams
+	Slots     []Slot
+	MAC       [headerMACSize]byte
+
+	// ad is what binds the chunks to the header, set once the header is
+	// sealed or verified (see chunkAD)
+	ad [headerMACSize]byte
+}
+
+// newSlotHeader returns a version 3 header holding 'slots', whose length is
+// rounded up to headerBlock.
+func newSlotHeader(plainSize int64, chunkSize int, c CipherID, slots []Slot) (*Header, error) {
+	if len(slots) == 0 || len(slots) > maxSlots {
+		return nil, fmt.Errorf("a file needs from 1 to %d slots, got %d", maxSlots, len(slots))
+	}
+	h := &Header{
+		Version:   formatVersion,
+		Cipher:    c,
+		ChunkSize: uint32(chunkSize),
+		PlainSize: uint64(plainSize),
+		Created:   time.Now().Unix(),
+		Slots:     slots,
+	}
+	size := len(h.body()) + headerMACSize
+	if size > maxHeaderSize {
+		return nil, fmt.Errorf("too many slots, the header would take %d bytes", size)
+	}
+	h.Length = blockLength(size)
+	return h, nil
+}
+
+// body encodes every header field except the MAC.
+func (h *Header) body() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	buf.WriteByte(h.Version)
+	binary.Write(&buf, binary.BigEndian, h.Length)
+	buf.WriteByte(byte(h.Cipher))
+	buf.WriteByte(h.Flags)
+	binary.Write(&buf, binary.BigEndian, h.ChunkSize)
+	binary.Write(&buf, binary.BigEndian, h.PlainSize)
+	if h.Version >= 2 {
+		binary.Write(&buf, binary.BigEndian, h.Created)
+	}
+	if h.Version >= 3 {
+		buf.WriteByte(byte(len(h.Slots)))
+		for _, s := range h.Slots {
+			buf.WriteByte(byte(s.Type))
+			binary.Write(&buf, binary.BigEndian, uint16(len(s.Data)))
+			buf.Write(s.Data)
+		}
+		return buf.Bytes()
+	}
+	writeKDFParams(&buf, h.KDF)
+	return buf.Bytes()
+}
+
+// Marshal returns the encoded header, MAC and padding included.
+func (h *Header) Marshal() []byte {
+	data := append(h.body(), h.MAC[:]...)
+	if len(data) < int(h.Length) {
+		data = append(data, make([]byte, int(h.Length)-len(data))...)
+	}
+	return data
+}
+
+// subkey derives the key for label from the file key with HKDF-SHA256. Up to
+// version 2 the file key itself does everything. A nil header is a legacy
+// file.
+func (h *Header) subkey(key [32]byte, label string) [32]byte {
+	if h == nil || h.Version < 3 {
+		return key
+	}
+	var sub [32]byte
+	// 32 bytes are far below the HKDF limit, the read cannot fail
+	io.ReadFull(hkdf.New(sha256.New, key[:], nil, []byte(label)), sub[:])
+	return sub
+}
+
+// chunkKey is the key of the AEAD sealing the chunks of the file with key.
+func (h *Header) chunkKey(key [32]byte) [32]byte {
+	return h.subkey(key, chunkLabel)
+}
+
+func (h *Header) computeMAC(key [32]byte) []byte {
+	macKey := h.subkey(key, headerMACLabel)
+	mac := hmac.New(sha256.New, macKey[:])
+	mac.Write(h.body())
+	return mac.Sum(nil)
+}
+
+// computeAD returns what chunkAD binds the chunks to. Up to version 2 it is
+// the MAC. From version 3 the MAC changes with the slots, so it is a MAC of
+// the fields describing the chunks only.
+func (h *Header) computeAD(key [32]byte) []byte {
+	if h.Version < 3 {
+		return h.MAC[:]
+	}
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	buf.WriteByte(h.Version)
+	buf.WriteByte(byte(h.Cipher))
+	buf.WriteByte(h.Flags)
+	binary.Write(&buf, binary.BigEndian, h.ChunkSize)
+	binary.Write(&buf, binary.BigEndian, h.PlainSize)
+	binary.Write(&buf, binary.BigEndian, h.Created)
+	macKey := h.subkey(key, headerMACLabel)
+	mac := hmac.New(sha256.New, macKey[:])
+	mac.Write(buf.Bytes())
+	return mac.Sum(nil)
+}
+
+// seal authenticates the header with the file key.
+func (h *Header) seal(key [32]byte) {
+	copy(h.MAC[:], h.computeMAC(key))
+	copy(h.ad[:], h.computeAD(key))
+}
+
+// verify checks the header MAC. A mismatch means either the key is wrong or
+// the header has been tampered with; the chunks are not even looked at.
+func (h *Header) verify(key [32]byte) error {
+	if !hmac.Equal(h.MAC[:], h.computeMAC(key)) {
+		return ErrWrongPassword
+	}
+	copy(h.ad[:], h.computeAD(key))
+	return nil
+}
+
+// IsArchive tells whether the payload is a directory archive.
+func (h *Header) IsArchive() bool {
+	return h.Flags&FlagArchive != 0
+}
+
+// EncChunkSize is the on-disk size of a full chunk.
+func (h *Header) EncChunkSize() int {
+	return int(h.ChunkSize) + h.Cipher.Overhead()
+}
+
+// NumChunks is the number of chunks the body holds according to PlainSize.
+// An empty file still has one (empty) final chunk, so that truncating the
+// whole body is detected.
+func (h *Header) NumChunks() int {
+	return max(1, int((h.PlainSize+uint64(h.ChunkSize)-1)/uint64(h.ChunkSize)))
+}
+
+// BodySize is the expected number of bytes following the header.
+func (h *Header) BodySize() int64 {
+	n := int64(h.NumChunks())
+	return int64(h.PlainSize) + n*int64(h.Cipher.Overhead())
+}
+
+// chunkAD is the associated data sealed with every chunk, in the spirit of the
+// STREAM construction: header MAC (see computeAD) + chunk index + final flag. Reordering or
+// duplicating chunks, splicing chunks from another file and truncating the
+// file at a chunk boundary all make the authentication fail.
+func (h *Header) chunkAD(index int, final bool) []byte {
+	ad := make([]byte, headerMACSize+8+1)
+	copy(ad, h.ad[:])
+	binary.BigEndian.PutUint64(ad[headerMACSize:], uint64(index))
+	if final {
+		ad[headerMACSize+8] = 1
+	}
+	return ad
+}
+
+// ReadHeader parses and validates the header at the start of r. It returns
+// ErrNoHeader if r does not start with the ghoji magic, which is the case for
+// files written before the header was introduced.
+func ReadHeader(r io.Reader) (*Header, error) {
+	pre := make([]byte, preambleSize)
+	if _, err := io.ReadFull(r, pre); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNoHeader
+		}
+		return nil, err
+	}
+	if string(pre[:len(magic)]) != magic {
+		return nil, ErrNoHeader
+	}
+
+	h := &Header{Version: pre[len(magic)]}
+	h.Length = binary.BigEndian.Uint32(pre[len(magic)+1:])
+	if h.Version < minFormatVersion || h.Version > formatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.Version)
+	}
+	if h.Length < uint32(preambleSize+headerMACSize) || h.Length > maxHeaderSize {
+		return nil, fmt.Errorf("%w: invalid header length %d", ErrCorrupted, h.Length)
+	}
+
+	rest := make([]byte, int(h.Length)-preambleSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("%w: truncated header", ErrCorrupted)
+	}
+	br := bytes.NewReader(rest)
+
+	var cipherID uint8
+	fields := []any{&cipherID, &h.Flags, &h.ChunkSize, &h.PlainSize}
+	if h.Version >= 2 {
+		fields = append(fields, &h.Created)
+	}
+	if h.Version < 3 {
+		fields = append(fields, &h.KDF.ID)
+	}
+	for _, f := range fields {
+		if err := binary.Read(br, binary.BigEndian, f); err != nil {
+			return nil, fmt.Errorf("%w: truncated header", ErrCorrupted)
+		}
+	}
+	h.Cipher = CipherID(cipherID)
+	if h.Version < 3 {
+		if err := readKDFParams(br, &h.KDF); err != nil {
+			return nil, err
+		}
+		if br.Len() != headerMACSize {
+			return nil, fmt.Errorf("%w: invalid header length %d", ErrCorrupted, h.Length)
+		}
+	} else {
+		if err := readSlots(br, h); err != nil {
+			return nil, err
+		}
+		// the padding after the MAC must be zero
+		if br.Len() < headerMACSize {
+			return nil, fmt.Errorf("%w: invalid header length %d", ErrCorrupted, h.Length)
+		}
+		padding := rest[len(rest)-br.Len()+headerMACSize:]
+		if !bytes.Equal(padding, make([]byte, len(padding))) {
+			return nil, fmt.Errorf("%w: invalid header padding", ErrCorrupted)
+		}
+	}
+	br.Read(h.MAC[:])
+
+	if !h.Cipher.supported() {
+		return nil, fmt.Errorf("unsupported cipher %s", h.Cipher)
+	}
+	if h.Version < 3 {
+		if err := h.KDF.check(); err != nil {
+			return nil, err
+		}
+	}
+	if h.ChunkSize < MinChunkSize || h.ChunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("%w: invalid chunk size %d", ErrCorrupted, h.ChunkSize)
+	}
+
+	return h, nil
+}
+
+// writeKDFParams encodes the KDF id followed by its parameters, as
+// readKDFParams decodes them.
+func writeKDFParams(buf *bytes.Buffer, p KDFParams) {
+	buf.WriteByte(byte(p.ID))
+	switch p.ID {
+	case KDFArgon2id:
+		binary.Write(buf, binary.BigEndian, p.Time)
+		binary.Write(buf, binary.BigEndian, p.Memory)
+		buf.WriteByte(p.Threads)
+	case KDFScrypt:
+		buf.WriteByte(p.LogN)
+		binary.Write(buf, binary.BigEndian, p.R)
+		binary.Write(buf, binary.BigEndian, p.P)
+	}
+	if p.ID != KDFSHA256 {
+		buf.WriteByte(byte(len(p.Salt)))
+		buf.Write(p.Salt)
+	}
+}
+
+// readSlots decodes the slots of a version 3 header. Slots of unknown types
+// are kept, an identity just cannot open them.
+func readSlots(br *bytes.Reader, h *Header) error {
+	count, err := br.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%w: truncated header", ErrCorrupted)
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: no slot in the header", ErrCorrupted)
+	}
+
+	h.Slots = make([]Slot, count)
+	for i := range h.Slots {
+		var size uint16
+		if err := binary.Read(br, binary.BigEndian, &h.Slots[i].Type); err != nil {
+			return fmt.Errorf("%w: truncated header", ErrCorrupted)
+		}
+		if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+			return fmt.Errorf("%w: truncated header", ErrCorrupted)
+		}
+		h.Slots[i].Data = make([]byte, size)
+		if _, err := io.ReadFull(br, h.Slots[i].Data); err != nil {
+			return fmt.Errorf("%w: truncated header", ErrCorrupted)
+		}
+	}
+	return nil
+}
+
+// readKDFParams decodes the parameters following the KDF id.
+func readKDFParams(br *bytes.Reader, p *KDFParams) error {
+	var fields []any
+	switch p.ID {
+	case KDFSHA256:
+		return nil
+	case KDFArgon2id:
+		fields = []any{&p.Time, &p.Memory, &p.Threads}
+	case KDFScrypt:
+		fields = []any{&p.LogN, &p.R, &p.P}
+	default:
+		return fmt.Errorf("unsupported key derivation %s", p.ID)
+	}
+
+	var saltLen uint8
+	fields = append(fields, &saltLen)
+	for _, f := range fields {
+		if err := binary.Read(br, binary.BigEndian, f); err != nil {
+			return fmt.Errorf("%w: truncated header", ErrCorrupted)
+		}
+	}
+
+	p.Salt = make([]byte, saltLen)
+	if _, err := io.ReadFull(br, p.Salt); err != nil {
+		return fmt.Errorf("%w: truncated header", ErrCorrupted)
+	}
+
+	return nil
+}
+
+// IsGhojiFile tells whether path looks like an encrypted file: it starts with
+// the header magic, or it is a headerless file with the .ji extension.
+func IsGhojiFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	pre := make([]byte, len(magic))
+	if _, err := io.ReadFull(file, pre); err == nil && string(pre) == magic {
+		return true
+	}
+	return filepath.Ext(path) == encExt
+}
+
+// ParseChunkSize parses a chunk size such as 65536, 64KiB or 4MiB (K, KB, M
+// and MB are binary units as well) and checks it against MinChunkSize and
+// MaxChunkSize. An empty string is DefaultChunkSize.
+func ParseChunkSize(s string) (int, error) {
+	value := strings.TrimSpace(s)
+	if value == "" {
+		return DefaultChunkSize, nil
+	}
+
+	units := []struct {
+		suffix string
+		size   int
+	}{{"KiB", 1024}, {"KB", 1024}, {"K", 1024}, {"MiB", 1024 * 1024}, {"MB", 1024 * 1024}, {"M", 1024 * 1024}, {"B", 1}}
+	unit := 1
+	for _, u := range units {
+		if strings.HasSuffix(strings.ToUpper(value), strings.ToUpper(u.suffix)) {
+			value, unit = strings.TrimSpace(value[:len(value)-len(u.suffix)]), u.size
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid chunk size %q", s)
+	}
+	size := n * unit
+	if n > MaxChunkSize || size < MinChunkSize || size > MaxChunkSize {
+		return 0, fmt.Errorf("the chunk size must be between 64KiB and 64MiB, got %d bytes", size)
+	}
+	return size, nil
+}
@@ -0,0 +1,163 @@
+package encryptor
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Info describes an encrypted file as its header tells, without the password.
+// Nothing of it is authenticated until the file is decrypted or verified.
+// Version is 0 for legacy (headerless) files. PlainSize is computed from the
+// size of the body for streamed files, whose header does not hold it. Created
+// is nil for the files written before it was recorded. KDF is nil for the files
+// whose key is wrapped in Slots instead.
+type Info struct {
+	Path      string     `json:"path"`
+	Version   int        `json:"version"`
+	Payload   string     `json:"payload"`
+	Streamed  bool       `json:"streamed"`
+	Cipher    string     `json:"cipher"`
+	KDF       *KDFInfo   `json:"kdf,omitempty"`
+	Slots     []SlotInfo `json:"slots,omitempty"`
+	ChunkSize int        `json:"chunk_size"`
+	Chunks    int        `json:"chunks"`
+	PlainSize int64      `json:"plain_size"`
+	Size      int64      `json:"size"`
+	Created   *time.Time `json:"created,omitempty"`
+}
+
+// KDFInfo holds the key derivation parameters of Info. MemoryKiB, Time and
+// Threads are set for argon2id, LogN, R and P for scrypt.
+type KDFInfo struct {
+	Name      string `json:"name"`
+	Time      uint32 `json:"time,omitempty"`
+	MemoryKiB uint32 `json:"memory_kib,omitempty"`
+	Threads   uint8  `json:"threads,omitempty"`
+	LogN      uint8  `json:"log_n,omitempty"`
+	R         uint32 `json:"r,omitempty"`
+	P         uint32 `json:"p,omitempty"`
+	SaltSize  int    `json:"salt_size"`
+	Summary   string `json:"summary"`
+}
+
+// SlotInfo describes a slot of the header. Tag is the short identifier of the
+// recipient of an X25519 slot, see X25519Recipient.Tag. KDF is set for the
+// password slots.
+type SlotInfo struct {
+	Type string   `json:"type"`
+	Tag  string   `json:"tag,omitempty"`
+	KDF  *KDFInfo `json:"kdf,omitempty"`
+}
+
+// Payload kinds of Info
+const (
+	PayloadFile    = "file"
+	PayloadArchive = "archive"
+)
+
+// Inspect reads the header of the encrypted file at path. Headerless files are
+// accepted as legacy files only if they end in .ji.
+func Inspect(path string) (*Info, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s\nerr:%s", path, err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s\nerr:%s", path, err)
+	}
+
+	header, err := ReadHeader(file)
+	if err == ErrNoHeader {
+		if filepath.Ext(path) != encExt {
+			return nil, fmt.Errorf("%s is not a ghoji file", path)
+		}
+		// the legacy layout is fixed: sha256 key, 1 MiB chunks, no trailing empty chunk
+		kdf := KDFParams{ID: KDFSHA256}
+		numChunks := int((stat.Size() + enc_chunkSize - 1) / enc_chunkSize)
+		return &Info{
+			Path:      path,
+			Payload:   PayloadFile,
+			Cipher:    CipherAES256GCM.String(),
+			KDF:       &KDFInfo{Name: kdf.ID.String(), Summary: kdf.String()},
+			ChunkSize: chunkSize,
+			Chunks:    numChunks,
+			PlainSize: stat.Size() - int64(numChunks)*(nonceSize+gcmTagSize),
+			Size:      stat.Size(),
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the header of %s\nerr:%s", path, err)
+	}
+
+	info := &Info{
+		Path:      path,
+		Version:   int(header.Version),
+		Payload:   PayloadFile,
+		Streamed:  header.Flags&FlagStream != 0,
+		Cipher:    header.Cipher.String(),
+		ChunkSize: int(header.ChunkSize),
+		Chunks:    header.NumChunks(),
+		PlainSize: int64(header.PlainSize),
+		Size:      stat.Size(),
+	}
+	if header.Version < 3 {
+		info.KDF = kdfInfo(header.KDF)
+	}
+	info.Slots = describeSlots(header.Slots)
+	if header.IsArchive() {
+		info.Payload = PayloadArchive
+	}
+	if info.Streamed {
+		bodySize := stat.Size() - int64(header.Length)
+		encChunkSize := int64(header.EncChunkSize())
+		info.Chunks = int((bodySize + encChunkSize - 1) / encChunkSize)
+		info.PlainSize = bodySize - int64(info.Chunks)*int64(header.Cipher.Overhead())
+	}
+	if header.Version >= 2 {
+		created := time.Unix(header.Created, 0)
+		info.Created = &created
+	}
+
+	return info, nil
+}
+
+func kdfInfo(p KDFParams) *KDFInfo {
+	return &KDFInfo{
+		Name:      p.ID.String(),
+		Time:      p.Time,
+		MemoryKiB: p.Memory,
+		Threads:   p.Threads,
+		LogN:      p.LogN,
+		R:         p.R,
+		P:         p.P,
+		SaltSize:  len(p.Salt),
+		Summary:   p.String(),
+	}
+}
+
+// describeSlots returns the SlotInfo of each slot, as far as it can be read
+// without opening it.
+func describeSlots(slots []Slot) []SlotInfo {
+	var infos []SlotInfo
+	for _, slot := range slots {
+		s := SlotInfo{Type: slot.Type.String()}
+		switch slot.Type {
+		case SlotX25519:
+			if len(slot.Data) >= tagSize {
+				s.Tag = hex.EncodeToString(slot.Data[:tagSize])
+			}
+		case SlotPassword, SlotKeyfile:
+			if p, _, err := parsePasswordSlot(slot); err == nil {
+				s.KDF = kdfInfo(p)
+			}
+		}
+		infos = append(infos, s)
+	}
+	return infos
+}
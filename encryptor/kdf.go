@@ -0,0 +1,255 @@
+package encryptor
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const saltSize = 16
+
+// keyfileLabel separates the mix of a password and a keyfile from any other
+// use of the hash of the keyfile.
+const keyfileLabel = "ghoji/v3/keyfile"
+
+// upper bounds accepted when reading parameters back from a header, so that a
+// forged file cannot make the decryption allocate an unbounded amount of memory
+const maxKDFMemory = 4 * 1024 * 1024 // KiB
+const maxKDFTime = 64
+const maxScryptLogN = 22
+const maxScryptR = 32
+const maxScryptP = 16
+
+// KDFParams holds the key derivation function and its cost parameters. They
+// are stored in the header, so decryption always uses the values chosen at
+// encryption time.
+// For Argon2id, Time is the number of passes, Memory is in KiB and Threads is
+// the degree of parallelism. For scrypt, N = 2^LogN, R is the block size and P
+// the parallelization.
+type KDFParams struct {
+	ID      KDFID
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	LogN    uint8
+	R       uint32
+	P       uint32
+	Salt    []byte
+}
+
+// DefaultKDF is Argon2id with the second recommended option of RFC 9106
+// (3 passes, 64 MiB, 4 lanes).
+var DefaultKDF = KDFParams{
+	ID:      KDFArgon2id,
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+// DefaultScrypt uses N=2^17, r=8, p=1 (128 MiB).
+var DefaultScrypt = KDFParams{
+	ID:   KDFScrypt,
+	LogN: 17,
+	R:    8,
+	P:    1,
+}
+
+// NewKDFParams builds the parameters from the values given on the command line.
+// memory is expressed in MiB. For scrypt, N is the largest power of two fitting
+// in memory and time is used as the parallelization p.
+// Zero values keep the defaults.
+func NewKDFParams(name string, time int, memory int, threads int) (KDFParams, error) {
+	if time < 0 || memory < 0 || threads < 0 {
+		return KDFParams{}, fmt.Errorf("kdf parameters cannot be negative")
+	}
+
+	switch name {
+	case "", "argon2id":
+		p := DefaultKDF
+		if time > 0 {
+			p.Time = uint32(time)
+		}
+		if memory > 0 {
+			p.Memory = uint32(memory) * 1024
+		}
+		if threads > 0 {
+			p.Threads = uint8(min(threads, 255))
+		}
+		return p, p.check()
+	case "scrypt":
+		p := DefaultScrypt
+		if memory > 0 {
+			// scrypt uses 128 * r * N bytes
+			n := uint64(memory) * 1024 * 1024 / (128 * uint64(p.R))
+			if n < 2 {
+				return KDFParams{}, fmt.Errorf("scrypt needs at least 1 MiB of memory")
+			}
+			p.LogN = uint8(bits.Len64(n) - 1)
+		}
+		if time > 0 {
+			p.P = uint32(time)
+		}
+		return p, p.check()
+	}
+
+	return KDFParams{}, fmt.Errorf("unknown kdf %q, use argon2id or scrypt", name)
+}
+
+// check validates the cost parameters against the accepted bounds.
+func (p *KDFParams) check() error {
+	switch p.ID {
+	case KDFSHA256:
+		return nil
+	case KDFArgon2id:
+		if p.Time == 0 || p.Time > maxKDFTime {
+			return fmt.Errorf("argon2id time must be between 1 and %d", maxKDFTime)
+		}
+		if p.Memory < 8*uint32(p.Threads) || p.Memory > maxKDFMemory {
+			return fmt.Errorf("argon2id memory must be between %d KiB and %d KiB", 8*uint32(p.Threads), maxKDFMemory)
+		}
+		if p.Threads == 0 {
+			return fmt.Errorf("argon2id threads must be at least 1")
+		}
+	case KDFScrypt:
+		if p.LogN < 1 || p.LogN > maxScryptLogN {
+			return fmt.Errorf("scrypt N must be between 2^1 and 2^%d", maxScryptLogN)
+		}
+		if p.R == 0 || p.R > maxScryptR {
+			return fmt.Errorf("scrypt r must be between 1 and %d", maxScryptR)
+		}
+		if p.P == 0 || p.P > maxScryptP {
+			return fmt.Errorf("scrypt p must be between 1 and %d", maxScryptP)
+		}
+		if p.memory() > maxKDFMemory*1024 {
+			return fmt.Errorf("scrypt with N=2^%d r=%d p=%d needs %d KiB, at most %d KiB are accepted", p.LogN, p.R, p.P, p.memory()>>10, maxKDFMemory)
+		}
+	default:
+		return fmt.Errorf("unsupported key derivation %s", p.ID)
+	}
+	return nil
+}
+
+// withSalt returns a copy of the parameters with a fresh random salt.
+func (p KDFParams) withSalt() (KDFParams, error) {
+	if p.ID == KDFSHA256 {
+		return p, nil
+	}
+	p.Salt = make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, p.Salt); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// kdfUsed is the memory of the key derivations running, within MaxKDFMemory.
+var (
+	kdfMu   sync.Mutex
+	kdfFree = sync.NewCond(&kdfMu)
+	kdfUsed int64
+)
+
+// acquireKDFMemory waits until n more bytes of derivations fit in
+// MaxKDFMemory, or no derivation is running.
+func acquireKDFMemory(n int64) {
+	kdfMu.Lock()
+	for kdfUsed > 0 && kdfUsed+n > MaxKDFMemory {
+		kdfFree.Wait()
+	}
+	kdfUsed += n
+	kdfMu.Unlock()
+}
+
+func releaseKDFMemory(n int64) {
+	kdfMu.Lock()
+	kdfUsed -= n
+	kdfFree.Broadcast()
+	kdfMu.Unlock()
+}
+
+// memory is the number of bytes a derivation with p allocates.
+func (p *KDFParams) memory() int64 {
+	switch p.ID {
+	case KDFArgon2id:
+		return int64(p.Memory) * 1024
+	case KDFScrypt:
+		return 128 * int64(p.R) * (int64(1)<<p.LogN + int64(p.P))
+	}
+	return 0
+}
+
+// deriveKey turns the password into the 32 byte chunk key. It waits for its
+// turn when other derivations already use MaxKDFMemory.
+func (p *KDFParams) deriveKey(password []byte) ([32]byte, error) {
+	var key [32]byte
+
+	if n := p.memory(); n > 0 {
+		acquireKDFMemory(n)
+		defer releaseKDFMemory(n)
+	}
+
+	switch p.ID {
+	case KDFSHA256:
+		key = sha256.Sum256(password)
+	case KDFArgon2id:
+		copy(key[:], argon2.IDKey(password, p.Salt, p.Time, p.Memory, p.Threads, 32))
+	case KDFScrypt:
+		k, err := scrypt.Key(password, p.Salt, 1<<p.LogN, int(p.R), int(p.P), 32)
+		if err != nil {
+			return key, err
+		}
+		copy(key[:], k)
+	default:
+		return key, fmt.Errorf("unsupported key derivation %s", p.ID)
+	}
+
+	return key, nil
+}
+
+func (p *KDFParams) String() string {
+	switch p.ID {
+	case KDFArgon2id:
+		return fmt.Sprintf("%s (time=%d, memory=%d MiB, threads=%d)", p.ID, p.Time, p.Memory/1024, p.Threads)
+	case KDFScrypt:
+		return fmt.Sprintf("%s (N=2^%d, r=%d, p=%d)", p.ID, p.LogN, p.R, p.P)
+	}
+	return p.ID.String()
+}
+
+// ReadKeyfile returns the hash of the keyfile at path, which is what
+// contributes to the key. Any file can be a keyfile, as long as it never
+// changes: a single different byte gives another key. Empty files are refused.
+func ReadKeyfile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the keyfile %s\nerr:%s", path, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the keyfile %s\nerr:%s", path, err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("the keyfile %s is empty", path)
+	}
+	return h.Sum(nil), nil
+}
+
+// mixKeyfile returns what the KDF derives the key from when a keyfile is
+// used: an HMAC of the password keyed by the hash of the keyfile, so that
+// neither opens the file without the other. The password can be empty.
+func mixKeyfile(password []byte, keyfile []byte) []byte {
+	mac := hmac.New(sha256.New, keyfile)
+	mac.Write([]byte(keyfileLabel))
+	mac.Write(password)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,94 @@
+package encryptor
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// forgedScrypt are scrypt parameters a forged header could carry, each far
+// beyond what a derivation may cost.
+var forgedScrypt = []struct {
+	name string
+	kdf  KDFParams
+}{
+	{"huge r", KDFParams{ID: KDFScrypt, LogN: 10, R: 1 << 20, P: 1}},
+	{"huge p", KDFParams{ID: KDFScrypt, LogN: 10, R: 1, P: 1 << 29}},
+	{"huge memory", KDFParams{ID: KDFScrypt, LogN: maxScryptLogN, R: maxScryptR, P: 1}},
+}
+
+func TestKDFCheckScrypt(t *testing.T) {
+	if err := DefaultScrypt.check(); err != nil {
+		t.Fatalf("default scrypt rejected: %v", err)
+	}
+	for _, tt := range forgedScrypt {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.kdf.check(); err == nil {
+				t.Fatalf("scrypt N=2^%d r=%d p=%d accepted", tt.kdf.LogN, tt.kdf.R, tt.kdf.P)
+			}
+		})
+	}
+}
+
+// v2Header returns a version 2 header derived with kdf.
+func v2Header(kdf KDFParams) []byte {
+	kdf.Salt = make([]byte, saltSize)
+	h := &Header{
+		Version:   2,
+		Cipher:    CipherAES256GCM,
+		ChunkSize: MinChunkSize,
+		KDF:       kdf,
+	}
+	h.Length = uint32(len(h.body()) + headerMACSize)
+	return h.Marshal()
+}
+
+func TestReadHeaderForgedScrypt(t *testing.T) {
+	if _, err := ReadHeader(bytes.NewReader(v2Header(DefaultScrypt))); err != nil {
+		t.Fatalf("header with default scrypt rejected: %v", err)
+	}
+	for _, tt := range forgedScrypt {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadHeader(bytes.NewReader(v2Header(tt.kdf))); err == nil {
+				t.Fatal("header with forged scrypt parameters accepted")
+			}
+		})
+	}
+}
+
+// forgedPasswordSlot returns a password slot claiming to be derived with kdf.
+func forgedPasswordSlot(kdf KDFParams) Slot {
+	kdf.Salt = make([]byte, saltSize)
+	var buf bytes.Buffer
+	writeKDFParams(&buf, kdf)
+	buf.Write(make([]byte, wrappedKeySize))
+	return Slot{Type: SlotPassword, Data: buf.Bytes()}
+}
+
+func TestForgedPasswordSlot(t *testing.T) {
+	for _, tt := range forgedScrypt {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := parsePasswordSlot(forgedPasswordSlot(tt.kdf)); err == nil {
+				t.Fatal("slot with forged scrypt parameters accepted")
+			}
+
+			// a whole file must be refused without deriving anything
+			h, err := newSlotHeader(MinChunkSize, MinChunkSize, CipherAES256GCM, []Slot{forgedPasswordSlot(tt.kdf)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.seal([32]byte{})
+			data := append(h.Marshal(), make([]byte, MinChunkSize+CipherAES256GCM.Overhead())...)
+			path := filepath.Join(t.TempDir(), "forged.ji")
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Verify(path, testPassword, nil, nil); !errors.Is(err, ErrWrongPassword) {
+				t.Fatalf("Verify = %v, want %v", err, ErrWrongPassword)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+)
+
+// keyring holds what can open an encrypted file: the password for the files
+// encrypted with one or with a password slot, the keyfile hash with it for the
+// keyfile slots, the identities for the slots of recipients.
+// fileKey, when set, is the key of a version 3 file just written by us, used
+// to check it without an identity.
+type keyring struct {
+	password   []byte
+	keyfile    []byte
+	identities []*X25519Identity
+	fileKey    *[32]byte
+}
+
+// open returns the key of the file with 'header', once the header MAC has
+// been checked with it: the chunk key up to version 2, the file key from
+// version 3 (see Header.chunkKey).
+func (k keyring) open(h *Header) ([32]byte, error) {
+	if h.Version < 3 {
+		key, err := h.KDF.deriveKey(k.password)
+		if err != nil {
+			return key, fmt.Errorf("unable to derive the key\nerr:%s", err)
+		}
+		return key, h.verify(key)
+	}
+
+	if k.fileKey != nil {
+		return *k.fileKey, k.verify(h, *k.fileKey)
+	}
+	key, _, err := k.openSlot(h)
+	return key, err
+}
+
+// openSlot unwraps the file key of a version 3 header with the identities
+// first, then with the password and the keyfile. It returns the index of the
+// slot that opened it as well.
+func (k keyring) openSlot(h *Header) ([32]byte, int, error) {
+	var passwords, keyfiles bool
+	for n, slot := range h.Slots {
+		for _, i := range k.identities {
+			if key, ok := i.unwrap(slot); ok {
+				return key, n, k.verify(h, key)
+			}
+		}
+		passwords = passwords || slot.Type == SlotPassword
+		keyfiles = keyfiles || slot.Type == SlotKeyfile
+	}
+	if (k.password != nil && passwords) || (k.keyfile != nil && keyfiles) {
+		for n, slot := range h.Slots {
+			if slot.Type == SlotPassword && k.password == nil {
+				continue
+			}
+			if key, ok := unwrapPassword(slot, k.password, k.keyfile); ok {
+				return key, n, k.verify(h, key)
+			}
+		}
+		if keyfiles && k.keyfile == nil {
+			return [32]byte{}, -1, fmt.Errorf("%w, or the file needs a keyfile too", ErrWrongPassword)
+		}
+		return [32]byte{}, -1, ErrWrongPassword
+	}
+
+	switch {
+	case len(k.identities) > 0:
+		return [32]byte{}, -1, ErrNoIdentity
+	case keyfiles && !passwords:
+		return [32]byte{}, -1, errors.New("the file is encrypted with a keyfile, the keyfile is needed to open it")
+	case passwords:
+		return [32]byte{}, -1, errors.New("the file is encrypted with a password, a password is needed to open it")
+	}
+	return [32]byte{}, -1, errors.New("the file is encrypted to public keys, an identity is needed to open it")
+}
+
+// verify checks the MAC of a version 3 header with the unwrapped key: a
+// mismatch can only be a change of the header, not a wrong key.
+func (k keyring) verify(h *Header, key [32]byte) error {
+	if err := h.verify(key); err != nil {
+		return fmt.Errorf("%w: the header does not match its file key", ErrCorrupted)
+	}
+	return nil
+}
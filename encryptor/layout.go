@@ -0,0 +1,92 @@
+package encryptor
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// layout tells where the chunks of an encrypted file are and how to open them.
+type layout struct {
+	header         *Header // nil for legacy files
+	info           os.FileInfo
+	key            [32]byte
+	aead           cipher.AEAD
+	overhead       int
+	dataOffset     int
+	plainChunkSize int
+	encChunkSize   int
+	bodySize       int
+	numChunks      int
+}
+
+// openLayout reads the header of the encrypted 'file' found at path, gets the
+// key from keys and checks it, then checks the size of the body.
+// Files without a header use the legacy layout, if they end in .ji.
+func openLayout(file *os.File, path string, keys keyring) (*layout, error) {
+	l := &layout{
+		key:            sha256.Sum256(keys.password),
+		plainChunkSize: chunkSize,
+		encChunkSize:   enc_chunkSize,
+	}
+	suite := CipherAES256GCM
+
+	header, err := ReadHeader(file)
+	switch {
+	case err == ErrNoHeader:
+		// without a header only the .ji extension tells us it is a legacy file
+		if filepath.Ext(path) != encExt {
+			return nil, fmt.Errorf("%s is not a ghoji file. I cannot perform a decryption", path)
+		}
+	case err != nil:
+		return nil, withBackupHint(path, fmt.Errorf("unable to read the header of %s\nerr:%s", path, err))
+	default:
+		l.key, err = keys.open(header)
+		if err != nil {
+			return nil, withBackupHint(path, err)
+		}
+		l.header = header
+		l.dataOffset = int(header.Length)
+		l.plainChunkSize = int(header.ChunkSize)
+		l.encChunkSize = header.EncChunkSize()
+		suite = header.Cipher
+	}
+
+	l.aead, err = suite.newAEAD(l.header.chunkKey(l.key))
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up %s\nerr:%s", suite, err)
+	}
+	l.overhead = suite.Overhead()
+
+	l.info, err = file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s\nerr:%s", path, err)
+	}
+
+	l.bodySize = int(l.info.Size()) - l.dataOffset
+	if header != nil && header.Flags&FlagStream == 0 && int64(l.bodySize) != header.BodySize() {
+		return nil, fmt.Errorf("%w: %s should hold %d encrypted bytes, found %d", ErrCorrupted, path, header.BodySize(), l.bodySize)
+	}
+
+	// only an empty legacy file has no chunks at all
+	l.numChunks = (l.bodySize + l.encChunkSize - 1) / l.encChunkSize
+	if l.numChunks == 0 && header != nil {
+		return nil, fmt.Errorf("%w: no chunk after the header of %s", ErrCorrupted, path)
+	}
+
+	return l, nil
+}
+
+// chunk returns the offset and the size of the sealed chunk 'index' in the
+// file, and its associated data.
+func (l *layout) chunk(index int) (int64, int, []byte) {
+	offset := l.dataOffset + index*l.encChunkSize
+	size := min(l.encChunkSize, l.bodySize-index*l.encChunkSize)
+	var ad []byte
+	if l.header != nil {
+		ad = l.header.chunkAD(index, index == l.numChunks-1)
+	}
+	return int64(offset), size, ad
+}
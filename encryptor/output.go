@@ -0,0 +1,58 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// decExt is appended when decrypting a file whose name does not end in .ji
+const decExt = ".decrypted"
+
+var ErrOutputExists = errors.New("output already exists, use --force to overwrite it")
+
+// EncryptedName is the default name of the encrypted copy of path.
+func EncryptedName(path string) string {
+	return filepath.Base(path) + encExt
+}
+
+// DecryptedName is the default name of the decrypted copy of path: the .ji
+// extension is removed, or decExt is appended if there is none.
+func DecryptedName(path string) string {
+	name := filepath.Base(path)
+	if strings.HasSuffix(name, encExt) && len(name) > len(encExt) {
+		return name[:len(name)-len(encExt)]
+	}
+	return name + decExt
+}
+
+// ResolveOutput returns the path where the result of processing 'input' is
+// written. An empty output means next to the input, an existing directory means
+// inside it, anything else is taken as the file path. 'name' is the default
+// file name (see EncryptedName and DecryptedName).
+func ResolveOutput(input string, output string, name string) string {
+	if output == "" {
+		return filepath.Join(filepath.Dir(input), name)
+	}
+	if info, err := os.Stat(output); err == nil && info.IsDir() {
+		return filepath.Join(output, name)
+	}
+	return output
+}
+
+// CheckOutput tells whether the output can be written at path: an existing file
+// is never replaced unless overwrite is set, and even then the input itself is
+// refused.
+func CheckOutput(path string, input string, overwrite bool) error {
+	if info, err := os.Stat(path); err == nil {
+		if in, err := os.Stat(input); err == nil && os.SameFile(info, in) {
+			return fmt.Errorf("%s is the input file itself", path)
+		}
+		if !overwrite {
+			return fmt.Errorf("%s: %w", path, ErrOutputExists)
+		}
+	}
+	return nil
+}
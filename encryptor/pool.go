@@ -0,0 +1,126 @@
+package encryptor
+
+import (
+	"context"
+	"sync"
+)
+
+// chunkCost is the memory taken by one chunk in flight: its plaintext and its
+// sealed buffer, whatever the cipher.
+func chunkCost(plainSize int) int64 {
+	return int64(plainSize) + int64(plainSize+maxOverhead)
+}
+
+// chunkWorkers is the number of chunks of 'plainSize' bytes an operation can
+// process at once: 'workers' (DefaultGoRoutines when not set) bounded by the
+// 'maxMemory' budget (MaxMemory when not set). At least one chunk is always
+// allowed, whatever the budget.
+func chunkWorkers(workers int, maxMemory int64, plainSize int) int {
+	if workers <= 0 {
+		workers = DefaultGoRoutines
+	}
+	if maxMemory <= 0 {
+		maxMemory = MaxMemory
+	}
+	if limit := maxMemory / chunkCost(plainSize); int64(workers) > limit {
+		workers = int(limit)
+	}
+	return max(1, workers)
+}
+
+// bufferPool recycles the chunk buffers of an operation. It keeps at most as
+// many free buffers as its capacity, so the memory held is bounded by the
+// chunks in flight.
+type bufferPool struct {
+	size int
+	free chan []byte
+}
+
+func newBufferPool(size int, capacity int) *bufferPool {
+	return &bufferPool{size: size, free: make(chan []byte, capacity)}
+}
+
+// get returns a buffer of length size.
+func (p *bufferPool) get() []byte {
+	select {
+	case b := <-p.free:
+		return b[:p.size]
+	default:
+		return make([]byte, p.size)
+	}
+}
+
+// put gives back a buffer obtained with get.
+func (p *bufferPool) put(b []byte) {
+	if cap(b) < p.size {
+		return
+	}
+	select {
+	case p.free <- b:
+	default:
+	}
+}
+
+// runChunks processes the chunks 0..numChunks-1 with a fixed pool of 'workers'
+// goroutines, no more than the chunks, fed by a bounded queue. Every worker
+// owns a plaintext buffer of 'plainSize' bytes and a sealed one of 'encSize'
+// bytes, reused for all its chunks and passed to 'process'. 'done' is called after each chunk processed.
+// The first failure cancels the chunks not started yet, as cancelling ctx
+// does; the chunks already in flight finish. Every failure is returned.
+func runChunks(ctx context.Context, numChunks int, workers int, plainSize int, encSize int, process func(index int, plain []byte, enc []byte) *ChunkError, done func()) []*ChunkError {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the buffers of idle workers would be allocated for nothing
+	workers = max(1, min(workers, numChunks))
+	jobs := make(chan int, workers)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []*ChunkError
+
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			plain := make([]byte, plainSize)
+			enc := make([]byte, encSize)
+			for {
+				var index int
+				select {
+				case i, ok := <-jobs:
+					if !ok {
+						return
+					}
+					index = i
+				case <-ctx.Done():
+					return
+				}
+				// a chunk queued before the cancellation is not started
+				if ctx.Err() != nil {
+					return
+				}
+				if err := process(index, plain, enc); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+					cancel()
+				}
+				done()
+			}
+		}()
+	}
+
+dispatch:
+	for i := 0; i < numChunks; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return errs
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package encryptor
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// processAlive tells whether a process with the given pid is running.
+func processAlive(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package encryptor
+
+import (
+	"os"
+)
+
+// processAlive tells whether a process with the given pid is running.
+func processAlive(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	// FindProcess opens a handle, which fails if the process does not exist
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,162 @@
+package encryptor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ReaderAt gives random access to the plaintext of an encrypted file: only
+// the chunks covering the bytes requested are read and authenticated. It
+// implements io.ReaderAt, safe for parallel calls, and io.ReadSeeker.
+type ReaderAt struct {
+	file   *os.File
+	layout *layout
+	size   int64
+
+	plain *bufferPool
+	enc   *bufferPool
+
+	mu       sync.Mutex
+	offset   int64
+	cache    []byte
+	cached   int
+	cacheSet bool
+}
+
+// OpenReaderAt checks the header of the encrypted 'file' with a key derived
+// from password, and keyfile when not nil, or with one of identities, as
+// GhojiFile.Decrypt does, and returns a ReaderAt over its plaintext. The file
+// must stay open while the ReaderAt is used.
+func OpenReaderAt(file *os.File, password []byte, keyfile []byte, identities []*X25519Identity) (*ReaderAt, error) {
+	l, err := openLayout(file, file.Name(), keyring{password: password, keyfile: keyfile, identities: identities})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReaderAt{
+		file:   file,
+		layout: l,
+		plain:  newBufferPool(l.plainChunkSize, MaxCPUs),
+		enc:    newBufferPool(l.encChunkSize, MaxCPUs),
+	}
+	// the size of the body is checked against the header, except for streamed
+	// and legacy files where it is all there is
+	r.size = int64(l.bodySize) - int64(l.numChunks)*int64(l.overhead)
+	return r, nil
+}
+
+// Size is the size of the plaintext.
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// chunk decrypts the chunk 'index' into a buffer of the plain pool.
+func (r *ReaderAt) chunk(index int) ([]byte, error) {
+	r.mu.Lock()
+	if r.cacheSet && r.cached == index {
+		data := append(r.plain.get()[:0], r.cache...)
+		r.mu.Unlock()
+		return data, nil
+	}
+	r.mu.Unlock()
+
+	offset, size, ad := r.layout.chunk(index)
+	buffer := r.enc.get()[:size]
+	defer r.enc.put(buffer)
+	if _, err := r.file.ReadAt(buffer, offset); err != nil && err != io.EOF {
+		return nil, &ChunkError{index, offset, fmt.Errorf("unable to read\nerr: %s", err)}
+	}
+	data, err := decryptBuffer(r.plain.get(), r.layout.aead, buffer, ad)
+	if err != nil {
+		return nil, &ChunkError{index, offset, fmt.Errorf("%w: %s", ErrCorrupted, err)}
+	}
+
+	// the last chunk is kept, small sequential reads hit it again and again
+	r.mu.Lock()
+	r.cache = append(r.cache[:0], data...)
+	r.cached = index
+	r.cacheSet = true
+	r.mu.Unlock()
+
+	return data, nil
+}
+
+// ReadAt reads len(p) bytes of plaintext starting at off. As io.ReaderAt
+// requires, fewer bytes are returned only with an error, io.EOF at the end of
+// the plaintext.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	n := 0
+	chunkSize := int64(r.layout.plainChunkSize)
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+
+		index := int(pos / chunkSize)
+		data, err := r.chunk(index)
+		if err != nil {
+			return n, err
+		}
+		start := int(pos - int64(index)*chunkSize)
+		if start >= len(data) {
+			r.plain.put(data)
+			return n, fmt.Errorf("%w: chunk %d is shorter than expected", ErrCorrupted, index)
+		}
+		n += copy(p[n:], data[start:])
+		r.plain.put(data)
+	}
+
+	return n, nil
+}
+
+// Read reads from the current offset, see Seek.
+func (r *ReaderAt) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	off := r.offset
+	r.mu.Unlock()
+
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.size-off {
+		p = p[:r.size-off]
+	}
+
+	n, err := r.ReadAt(p, off)
+	r.mu.Lock()
+	r.offset = off + int64(n)
+	r.mu.Unlock()
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read, as io.Seeker.
+func (r *ReaderAt) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,279 @@
+package encryptor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Textual forms of the X25519 keys: the key and a 4 byte checksum, base64url.
+const recipientPrefix = "ghoji-pub-"
+const identityPrefix = "GHOJI-SECRET-KEY-"
+
+// x25519Label separates the wrapping keys of ghoji from any other use of the
+// same shared secret.
+const x25519Label = "ghoji/v3/x25519"
+
+// tagSize is the size of the recipient tag at the start of an X25519 slot.
+const tagSize = 4
+
+// size of the data of an X25519 slot: tag + ephemeral public key + wrapped
+// file key
+const x25519SlotSize = tagSize + curve25519.PointSize + 32 + chacha20poly1305.Overhead
+
+// X25519Recipient is a public key a file can be encrypted to. The file key is
+// wrapped in a slot with a key agreed between a fresh ephemeral key and the
+// recipient, so that only the matching X25519Identity can unwrap it. The slot
+// holds a short tag of the public key, not the key itself.
+type X25519Recipient struct {
+	key [curve25519.PointSize]byte
+}
+
+// X25519Identity is the private key of an X25519Recipient.
+type X25519Identity struct {
+	key       [curve25519.ScalarSize]byte
+	recipient *X25519Recipient
+}
+
+// GenerateX25519Identity returns a new random identity.
+func GenerateX25519Identity() (*X25519Identity, error) {
+	var key [curve25519.ScalarSize]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, err
+	}
+	return newX25519Identity(key)
+}
+
+func newX25519Identity(key [curve25519.ScalarSize]byte) (*X25519Identity, error) {
+	pub, err := curve25519.X25519(key[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	i := &X25519Identity{key: key, recipient: &X25519Recipient{}}
+	copy(i.recipient.key[:], pub)
+	return i, nil
+}
+
+// Recipient returns the public key of the identity.
+func (i *X25519Identity) Recipient() *X25519Recipient {
+	return i.recipient
+}
+
+// String encodes the identity as GHOJI-SECRET-KEY-...
+func (i *X25519Identity) String() string {
+	return encodeKey(identityPrefix, i.key[:])
+}
+
+// String encodes the recipient as ghoji-pub-...
+func (r *X25519Recipient) String() string {
+	return encodeKey(recipientPrefix, r.key[:])
+}
+
+// ParseX25519Recipient decodes a public key written by
+// X25519Recipient.String.
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	key, err := decodeKey(recipientPrefix, strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q\nerr:%s", s, err)
+	}
+	r := &X25519Recipient{}
+	copy(r.key[:], key)
+	return r, nil
+}
+
+// ParseX25519Identity decodes a private key written by
+// X25519Identity.String.
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	key, err := decodeKey(identityPrefix, strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity\nerr:%s", err)
+	}
+	var scalar [curve25519.ScalarSize]byte
+	copy(scalar[:], key)
+	return newX25519Identity(scalar)
+}
+
+// ReadIdentities parses an identity file as written by WriteIdentity: one
+// identity per line, blank lines and lines starting with # are skipped.
+func ReadIdentities(r io.Reader) ([]*X25519Identity, error) {
+	var identities []*X25519Identity
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i, err := ParseX25519Identity(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		identities = append(identities, i)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no identity found")
+	}
+	return identities, nil
+}
+
+// ReadIdentityFile reads the identities of the file at path, see
+// ReadIdentities.
+func ReadIdentityFile(path string) ([]*X25519Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s\nerr:%s", path, err)
+	}
+	defer file.Close()
+
+	identities, err := ReadIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the identities of %s\nerr:%s", path, err)
+	}
+	return identities, nil
+}
+
+// WriteIdentity writes i to w in the format of ReadIdentities, with its
+// creation time and public key as comments.
+func WriteIdentity(w io.Writer, i *X25519Identity) error {
+	_, err := fmt.Fprintf(w, "# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), i.Recipient(), i)
+	return err
+}
+
+func encodeKey(prefix string, key []byte) string {
+	sum := sha256.Sum256(key)
+	return prefix + base64.RawURLEncoding.EncodeToString(append(key[:len(key):len(key)], sum[:4]...))
+}
+
+func decodeKey(prefix string, s string) ([]byte, error) {
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("it does not start with %s", prefix)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s[len(prefix):])
+	if err != nil || len(data) != 32+4 {
+		return nil, fmt.Errorf("malformed key")
+	}
+	key := data[:32]
+	sum := sha256.Sum256(key)
+	if !bytes.Equal(sum[:4], data[32:]) {
+		return nil, fmt.Errorf("wrong checksum, the key is mistyped")
+	}
+	return key, nil
+}
+
+// tag is the short, public identifier of r in the slots it opens.
+func (r *X25519Recipient) tag() []byte {
+	sum := sha256.Sum256(r.key[:])
+	return sum[:tagSize]
+}
+
+// Tag is the tag of r in hex, as shown by Inspect for the slots of r.
+func (r *X25519Recipient) Tag() string {
+	return hex.EncodeToString(r.tag())
+}
+
+// wrappingKey derives the key wrapping the file key from the shared secret of
+// the ephemeral key and the recipient.
+func wrappingKey(shared []byte, ephemeral []byte, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(x25519Label)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// wrap returns a slot holding fileKey for r: tag + ephemeral public key +
+// fileKey sealed with ChaCha20-Poly1305. The wrapping key is used once, so
+// the nonce is zero.
+func (r *X25519Recipient) wrap(fileKey [32]byte) (Slot, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, ephemeral); err != nil {
+		return Slot{}, err
+	}
+	ephemeralPub, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return Slot{}, err
+	}
+	shared, err := curve25519.X25519(ephemeral, r.key[:])
+	if err != nil {
+		return Slot{}, err
+	}
+	key, err := wrappingKey(shared, ephemeralPub, r.key[:])
+	if err != nil {
+		return Slot{}, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return Slot{}, err
+	}
+
+	data := append(r.tag(), ephemeralPub...)
+	data = aead.Seal(data, make([]byte, chacha20poly1305.NonceSize), fileKey[:], nil)
+	return Slot{Type: SlotX25519, Data: data}, nil
+}
+
+// unwrap returns the file key held by slot, if it was wrapped for i.
+func (i *X25519Identity) unwrap(slot Slot) ([32]byte, bool) {
+	var fileKey [32]byte
+	if slot.Type != SlotX25519 || len(slot.Data) != x25519SlotSize {
+		return fileKey, false
+	}
+	if !bytes.Equal(slot.Data[:tagSize], i.recipient.tag()) {
+		return fileKey, false
+	}
+
+	ephemeralPub := slot.Data[tagSize : tagSize+curve25519.PointSize]
+	shared, err := curve25519.X25519(i.key[:], ephemeralPub)
+	if err != nil {
+		return fileKey, false
+	}
+	key, err := wrappingKey(shared, ephemeralPub, i.recipient.key[:])
+	if err != nil {
+		return fileKey, false
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return fileKey, false
+	}
+	plain, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), slot.Data[tagSize+curve25519.PointSize:], nil)
+	if err != nil || len(plain) != len(fileKey) {
+		return fileKey, false
+	}
+	copy(fileKey[:], plain)
+	return fileKey, true
+}
+
+// newRecipientHeader draws a random file key and returns a version 3 header
+// with a slot for each recipient, along with the key.
+func newRecipientHeader(plainSize int64, chunkSize int, c CipherID, recipients []*X25519Recipient) (*Header, [32]byte, error) {
+	fileKey, err := newFileKey()
+	if err != nil {
+		return nil, fileKey, err
+	}
+
+	slots := make([]Slot, len(recipients))
+	for n, r := range recipients {
+		slot, err := r.wrap(fileKey)
+		if err != nil {
+			return nil, fileKey, err
+		}
+		slots[n] = slot
+	}
+
+	header, err := newSlotHeader(plainSize, chunkSize, c, slots)
+	return header, fileKey, err
+}
@@ -0,0 +1,146 @@
+package encryptor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Rekey changes the password of the encrypted file at path from password to
+// newPassword, derived with kdf (DefaultKDF when not set). keyfile and
+// newKeyfile are the hashes of the keyfiles going with them, nil for none
+// (see ReadKeyfile). The plaintext is never written to disk.
+// For version 3 files only the password slot opened by password is replaced,
+// the header is rewritten and the chunks are left as they are (see
+// SlotEditor.Save). The other slots keep working. Older files have no file
+// key to keep: they are decrypted and encrypted again as a stream, with a new
+// random key in a version 3 layout of the same chunk size and cipher, into a
+// temporary file that replaces the original once read back with the new
+// password.
+func Rekey(ctx context.Context, path string, password []byte, keyfile []byte, newPassword []byte, newKeyfile []byte, kdf KDFParams) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open %s\nerr:%s", path, err)
+	}
+	header, err := ReadHeader(file)
+	file.Close()
+	if err != nil && err != ErrNoHeader {
+		return fmt.Errorf("unable to read the header of %s\nerr:%s", path, err)
+	}
+
+	if header == nil || header.Version < 3 {
+		return reencrypt(ctx, path, header, password, newPassword, newKeyfile, kdf)
+	}
+
+	editor, err := OpenSlots(path, password, keyfile, nil)
+	if err != nil {
+		return err
+	}
+	slot, err := passwordSlot(newPassword, newKeyfile, kdf, editor.key)
+	if err != nil {
+		return err
+	}
+	editor.header.Slots[editor.opened] = slot
+	return editor.Save()
+}
+
+// reencrypt rewrites the file at path, a legacy file (nil header) or a version
+// 1-2 file, under newPassword and newKeyfile. The output keeps the chunk size,
+// the cipher and the payload kind of the original.
+func reencrypt(ctx context.Context, path string, header *Header, password []byte, newPassword []byte, newKeyfile []byte, kdf KDFParams) error {
+	info, err := Inspect(path)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open %s\nerr:%s", path, err)
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to read %s\nerr:%s", path, err)
+	}
+
+	out, err := CreateAtomic(path, "", true)
+	if err != nil {
+		return fmt.Errorf("unable to create the new %s\nerr:%s", path, err)
+	}
+	defer out.Abort()
+	out.Chmod(stat.Mode().Perm())
+
+	r := NewReader(src, password)
+	defer r.Close()
+	var w *Writer
+	if info.Streamed {
+		w = NewWriter(out, newPassword)
+	} else {
+		w = newSizedWriter(out, newPassword, info.PlainSize)
+	}
+	w.KDF = kdf
+	w.Keyfile = newKeyfile
+	w.ChunkSize, w.Cipher = chunkSize, CipherAES256GCM
+	if header != nil {
+		w.ChunkSize, w.Cipher = int(header.ChunkSize), header.Cipher
+		w.Archive = header.IsArchive()
+	}
+
+	// the plaintext is hashed on the way, to check the new file against it
+	h := sha256.New()
+	if err := copyContext(ctx, io.MultiWriter(w, h), r); err != nil {
+		w.CloseWithError(err)
+		if ctx.Err() != nil {
+			return interrupted(ctx, path)
+		}
+		return fmt.Errorf("unable to re-encrypt %s\nerr:%w", path, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("unable to re-encrypt %s\nerr:%w", path, err)
+	}
+
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	check := NewReader(out, newPassword)
+	check.Keyfile = newKeyfile
+	defer check.Close()
+	newHash, err := hashReader(check)
+	if err != nil {
+		return fmt.Errorf("%w\nerr: %s", ErrVerifyFailed, err)
+	}
+	if !bytes.Equal(h.Sum(nil), newHash) {
+		return ErrVerifyFailed
+	}
+
+	if err := out.Commit(); err != nil {
+		return fmt.Errorf("unable to move the new file to %s\nerr:%s", path, err)
+	}
+	return nil
+}
+
+// copyContext copies src to dst until EOF, an error or the cancellation of
+// ctx, checked between reads.
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) error {
+	buf := make([]byte, 256*1024)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A resumable run writes its output to .<final name>.ghoji-part and records in
+// .<final name>.ghoji-journal every chunk written there. Both names are stable,
+// so that the next run with Resume finds them and processes only the chunks
+// missing. They are not temporaries of a process (see FindOrphans): they stay
+// until the run completes or they are removed by hand.
+const partExt = ".ghoji-part"
+const journalExt = ".ghoji-journal"
+
+const journalMagic = "GHOJIJNL"
+const journalVersion = 1
+
+// journalRecordSize is the size of a record: chunk index u64 + hash of the
+// chunk as written in the output.
+const journalRecordSize = 8 + sha256.Size
+
+const (
+	journalEncrypt = 1
+	journalDecrypt = 2
+)
+
+// journalID identifies the run a journal belongs to. A journal left by a run on
+// another version of the source is discarded.
+type journalID struct {
+	Mode      uint8
+	Size      int64
+	ModTime   int64
+	NumChunks uint64
+	ChunkSize uint32
+}
+
+func (id journalID) marshal() []byte {
+	var b bytes.Buffer
+	b.WriteString(journalMagic)
+	b.WriteByte(journalVersion)
+	binary.Write(&b, binary.BigEndian, id)
+	return b.Bytes()
+}
+
+// journal is the record of the chunks already in the partial output of a
+// resumable run, safe for concurrent use by the workers.
+type journal struct {
+	file *os.File
+	mu   sync.Mutex
+	done map[int][sha256.Size]byte
+}
+
+// resumePaths returns the partial output and the journal of the output 'path'.
+func resumePaths(path string) (string, string) {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+partExt), filepath.Join(dir, "."+name+journalExt)
+}
+
+// IsTemporary tells whether path is a temporary of ghoji: the hidden output of
+// a run in progress, the partial output and journal of a resumable one or the
+// header backup of a slot change. They are never taken as inputs.
+func IsTemporary(path string) bool {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, ".") {
+		return false
+	}
+	return strings.HasSuffix(name, tmpExt) || strings.HasSuffix(name, partExt) || strings.HasSuffix(name, journalExt) || strings.HasSuffix(name, headerBackupExt)
+}
+
+// openJournal opens the journal at path, or creates it when it is missing, it
+// belongs to a different run or it cannot be read. The records torn by a crash
+// are dropped. It returns whether the previous records are kept.
+func openJournal(path string, id journalID) (*journal, bool, error) {
+	header := id.marshal()
+	j := &journal{done: make(map[int][sha256.Size]byte)}
+
+	if data, err := os.ReadFile(path); err == nil && bytes.HasPrefix(data, header) {
+		records := data[len(header):]
+		records = records[:len(records)-len(records)%journalRecordSize]
+		for len(records) > 0 {
+			index := binary.BigEndian.Uint64(records)
+			if index < id.NumChunks {
+				var sum [sha256.Size]byte
+				copy(sum[:], records[8:journalRecordSize])
+				j.done[int(index)] = sum
+			}
+			records = records[journalRecordSize:]
+		}
+
+		file, err := os.OpenFile(path, os.O_RDWR, 0600)
+		if err == nil {
+			size := int64(len(data) - (len(data)-len(header))%journalRecordSize)
+			if err := file.Truncate(size); err == nil {
+				if _, err := file.Seek(size, io.SeekStart); err == nil {
+					j.file = file
+					return j, true, nil
+				}
+			}
+			file.Close()
+		}
+		j.done = make(map[int][sha256.Size]byte)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, false, err
+	}
+	j.file = file
+	return j, false, nil
+}
+
+// written tells whether the chunk 'index' was recorded and the 'size' bytes at
+// 'offset' of out still hash to the recorded value. 'buffer' must hold at least
+// size bytes.
+func (j *journal) written(out io.ReaderAt, index int, offset int64, size int, buffer []byte) bool {
+	j.mu.Lock()
+	sum, ok := j.done[index]
+	j.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	buffer = buffer[:size]
+	if _, err := out.ReadAt(buffer, offset); err != nil && err != io.EOF {
+		return false
+	}
+	return sha256.Sum256(buffer) == sum
+}
+
+// record adds the chunk 'index', whose bytes in the output are 'data'.
+func (j *journal) record(index int, data []byte) error {
+	record := make([]byte, journalRecordSize)
+	binary.BigEndian.PutUint64(record, uint64(index))
+	sum := sha256.Sum256(data)
+	copy(record[8:], sum[:])
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done[index] = sum
+	_, err := j.file.Write(record)
+	return err
+}
+
+// reset forgets every record, when the partial output cannot be trusted.
+func (j *journal) reset() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done = make(map[int][sha256.Size]byte)
+	size := int64(len(journalMagic) + 1 + binary.Size(journalID{}))
+	if err := j.file.Truncate(size); err != nil {
+		return err
+	}
+	_, err := j.file.Seek(size, io.SeekStart)
+	return err
+}
+
+// resumed is the number of chunks recorded by the previous runs.
+func (j *journal) resumed() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.done)
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// remove deletes the journal once the run is complete.
+func (j *journal) remove() error {
+	j.file.Close()
+	return os.Remove(j.file.Name())
+}
+
+// createResumable opens the partial output of 'path' and its journal, checked
+// with CheckOutput against the input like CreateAtomic. The partial output is
+// kept by Abort, and the journal must be removed once the output is committed.
+// When the journal does not belong to this run (see journalID) both start
+// empty.
+func createResumable(path string, input string, overwrite bool, id journalID) (*AtomicFile, *journal, error) {
+	if err := CheckOutput(path, input, overwrite); err != nil {
+		return nil, nil, err
+	}
+
+	partPath, journalPath := resumePaths(path)
+	j, resumed, err := openJournal(journalPath, id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open the journal %s\nerr:%s", journalPath, err)
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	if !resumed {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(partPath, flags, 0600)
+	if err != nil {
+		j.close()
+		return nil, nil, err
+	}
+
+	return &AtomicFile{File: file, path: path, overwrite: overwrite, keep: true}, j, nil
+}
+
+// sourceID fills the part of the journalID that depends on the source file.
+func sourceID(mode uint8, info os.FileInfo, numChunks int, chunkSize int) journalID {
+	return journalID{
+		Mode:      mode,
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UnixNano(),
+		NumChunks: uint64(numChunks),
+		ChunkSize: uint32(chunkSize),
+	}
+}
+
+// resumeHeader reads the header of the partial output of an encryption and
+// opens its key with keys. The header must be the one of a file of plainSize bytes in
+// chunks of chunkSize sealed with c. ErrWrongPassword means that the run was started with another
+// password; any other error that the header is unusable and the run must start
+// over.
+func resumeHeader(out io.ReaderAt, keys keyring, plainSize int64, chunkSize int, c CipherID) (*Header, [32]byte, error) {
+	var key [32]byte
+	header, err := ReadHeader(io.NewSectionReader(out, 0, maxHeaderSize))
+	if err != nil {
+		return nil, key, err
+	}
+	if header.PlainSize != uint64(plainSize) || header.ChunkSize != uint32(chunkSize) || header.Cipher != c || header.Flags != 0 {
+		return nil, key, fmt.Errorf("%w: the partial output belongs to another file", ErrCorrupted)
+	}
+	key, err = keys.open(header)
+	if err != nil {
+		return nil, key, err
+	}
+	return header, key, nil
+}
@@ -0,0 +1,393 @@
+package encryptor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// headerBackupExt ends the name of the copy of the previous header, kept as
+// .<name>.ghoji-header while a header is rewritten in place (see
+// SlotEditor.Save).
+const headerBackupExt = ".ghoji-header"
+
+// wrappedKeySize is the size of a file key sealed with ChaCha20-Poly1305.
+const wrappedKeySize = 32 + chacha20poly1305.Overhead
+
+// newFileKey draws the random key of a version 3 file.
+func newFileKey() ([32]byte, error) {
+	var key [32]byte
+	_, err := io.ReadFull(rand.Reader, key[:])
+	return key, err
+}
+
+// passwordSlot returns a slot holding fileKey for password: the KDF id and
+// parameters, with a fresh salt, then fileKey sealed with ChaCha20-Poly1305
+// under the key derived from password. The salt makes the derived key unique,
+// so the nonce is zero. With a keyfile (its hash, see ReadKeyfile) the slot is
+// a SlotKeyfile, derived from both.
+func passwordSlot(password []byte, keyfile []byte, kdf KDFParams, fileKey [32]byte) (Slot, error) {
+	if kdf.ID == 0 {
+		kdf = DefaultKDF
+	}
+	if kdf.ID == KDFSHA256 {
+		return Slot{}, fmt.Errorf("a password slot needs a salted key derivation, not %s", kdf.ID)
+	}
+	params, err := kdf.withSalt()
+	if err != nil {
+		return Slot{}, fmt.Errorf("unable to generate the salt\nerr:%s", err)
+	}
+	secret, slotType := password, SlotPassword
+	if keyfile != nil {
+		secret, slotType = mixKeyfile(password, keyfile), SlotKeyfile
+	}
+	key, err := params.deriveKey(secret)
+	if err != nil {
+		return Slot{}, fmt.Errorf("unable to derive the key\nerr:%s", err)
+	}
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return Slot{}, err
+	}
+
+	var buf bytes.Buffer
+	writeKDFParams(&buf, params)
+	data := aead.Seal(buf.Bytes(), make([]byte, chacha20poly1305.NonceSize), fileKey[:], nil)
+	return Slot{Type: slotType, Data: data}, nil
+}
+
+// parsePasswordSlot returns the KDF parameters of a password or keyfile slot
+// and the wrapped file key.
+func parsePasswordSlot(slot Slot) (KDFParams, []byte, error) {
+	var p KDFParams
+	if slot.Type != SlotPassword && slot.Type != SlotKeyfile {
+		return p, nil, fmt.Errorf("not a password slot")
+	}
+	br := bytes.NewReader(slot.Data)
+	id, err := br.ReadByte()
+	if err != nil {
+		return p, nil, fmt.Errorf("%w: truncated password slot", ErrCorrupted)
+	}
+	p.ID = KDFID(id)
+	if p.ID == KDFSHA256 {
+		return p, nil, fmt.Errorf("%w: unsalted password slot", ErrCorrupted)
+	}
+	if err := readKDFParams(br, &p); err != nil {
+		return p, nil, err
+	}
+	if err := p.check(); err != nil {
+		return p, nil, err
+	}
+	if br.Len() != wrappedKeySize {
+		return p, nil, fmt.Errorf("%w: invalid password slot", ErrCorrupted)
+	}
+	return p, slot.Data[len(slot.Data)-wrappedKeySize:], nil
+}
+
+// unwrapPassword returns the file key held by slot, if it was wrapped for
+// password, and keyfile for a keyfile slot.
+func unwrapPassword(slot Slot, password []byte, keyfile []byte) ([32]byte, bool) {
+	var fileKey [32]byte
+	params, wrapped, err := parsePasswordSlot(slot)
+	if err != nil {
+		return fileKey, false
+	}
+	secret := password
+	if slot.Type == SlotKeyfile {
+		if keyfile == nil {
+			return fileKey, false
+		}
+		secret = mixKeyfile(password, keyfile)
+	}
+	key, err := params.deriveKey(secret)
+	if err != nil {
+		return fileKey, false
+	}
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return fileKey, false
+	}
+	plain, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), wrapped, nil)
+	if err != nil || len(plain) != len(fileKey) {
+		return fileKey, false
+	}
+	copy(fileKey[:], plain)
+	return fileKey, true
+}
+
+// newPasswordHeader draws a random file key and returns a version 3 header
+// with a single slot for password, and keyfile if not nil, along with the key.
+func newPasswordHeader(plainSize int64, chunkSize int, c CipherID, password []byte, keyfile []byte, kdf KDFParams) (*Header, [32]byte, error) {
+	fileKey, err := newFileKey()
+	if err != nil {
+		return nil, fileKey, err
+	}
+	slot, err := passwordSlot(password, keyfile, kdf, fileKey)
+	if err != nil {
+		return nil, fileKey, err
+	}
+	header, err := newSlotHeader(plainSize, chunkSize, c, []Slot{slot})
+	return header, fileKey, err
+}
+
+// SlotEditor changes the slots of a version 3 file, each holding a copy of the
+// file key that seals the chunks, without touching the chunks: whoever opens
+// one slot can add or remove the others. Removing a slot does not lock out who
+// already read the file key, only re-encrypting the file does. The changes are
+// written by Save.
+type SlotEditor struct {
+	path   string
+	header *Header
+	key    [32]byte
+	opened int
+}
+
+// OpenSlots opens the file key of the file at path with password, keyfile (the
+// hash of the keyfile, see ReadKeyfile) or one of identities (any can be nil).
+// Files before version 3 have no slots, their key is derived from the password
+// itself.
+// A header backup left by an interrupted Save is dealt with first: it is
+// restored if the header in the file cannot be opened, removed otherwise.
+func OpenSlots(path string, password []byte, keyfile []byte, identities []*X25519Identity) (*SlotEditor, error) {
+	keys := keyring{password: password, keyfile: keyfile, identities: identities}
+	backupPath := headerBackupPath(path)
+	if _, err := os.Stat(backupPath); err == nil {
+		if err := recoverHeader(path, backupPath, keys); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s\nerr:%s", path, err)
+	}
+	defer file.Close()
+
+	header, err := ReadHeader(file)
+	if err == ErrNoHeader {
+		return nil, fmt.Errorf("%s has no header: it is a legacy file, whose key is the hash of the password", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the header of %s\nerr:%s", path, err)
+	}
+	if header.Version < 3 {
+		return nil, fmt.Errorf("%s uses format version %d, whose key is derived from the password itself: it has no slots", path, header.Version)
+	}
+
+	key, opened, err := keys.openSlot(header)
+	if err != nil {
+		return nil, err
+	}
+	return &SlotEditor{path: path, header: header, key: key, opened: opened}, nil
+}
+
+// Slots describes the slots of the file, in order.
+func (e *SlotEditor) Slots() []SlotInfo {
+	return describeSlots(e.header.Slots)
+}
+
+// Opened is the index of the slot that opened the file, -1 once removed.
+func (e *SlotEditor) Opened() int {
+	return e.opened
+}
+
+// AddPassword adds a slot for password, and keyfile if not nil, with a key
+// derived with kdf (DefaultKDF when not set).
+func (e *SlotEditor) AddPassword(password []byte, keyfile []byte, kdf KDFParams) error {
+	slot, err := passwordSlot(password, keyfile, kdf, e.key)
+	if err != nil {
+		return err
+	}
+	return e.add(slot)
+}
+
+// AddRecipient adds a slot for r.
+func (e *SlotEditor) AddRecipient(r *X25519Recipient) error {
+	slot, err := r.wrap(e.key)
+	if err != nil {
+		return fmt.Errorf("unable to wrap the file key\nerr:%s", err)
+	}
+	return e.add(slot)
+}
+
+func (e *SlotEditor) add(slot Slot) error {
+	if len(e.header.Slots) >= maxSlots {
+		return fmt.Errorf("a file has at most %d slots", maxSlots)
+	}
+	e.header.Slots = append(e.header.Slots, slot)
+	return nil
+}
+
+// Remove deletes the slot 'index'. The last slot cannot be removed, the file
+// could not be opened anymore.
+func (e *SlotEditor) Remove(index int) error {
+	if index < 0 || index >= len(e.header.Slots) {
+		return fmt.Errorf("there is no slot %d, the file has %d", index, len(e.header.Slots))
+	}
+	if len(e.header.Slots) == 1 {
+		return errors.New("the last slot cannot be removed")
+	}
+	e.header.Slots = append(e.header.Slots[:index:index], e.header.Slots[index+1:]...)
+	switch {
+	case index == e.opened:
+		e.opened = -1
+	case index < e.opened:
+		e.opened--
+	}
+	return nil
+}
+
+// Save writes the new header. When it fits in the space of the old one it
+// is written in place, the old one being kept in a backup until the new one is
+// synced (see OpenSlots). Otherwise the file is rewritten next to itself with
+// the chunks copied as they are, and renamed over the old one.
+func (e *SlotEditor) Save() error {
+	oldLength := e.header.Length
+	size := len(e.header.body()) + headerMACSize
+	if size > maxHeaderSize {
+		return fmt.Errorf("too many slots, the header would take %d bytes", size)
+	}
+	if size > int(oldLength) {
+		e.header.Length = blockLength(size)
+	}
+	e.header.seal(e.key)
+
+	if e.header.Length == oldLength {
+		return rewriteHeader(e.path, e.header.Marshal())
+	}
+	return rewriteFile(e.path, e.header.Marshal(), int64(oldLength))
+}
+
+// blockLength is the length of a version 3 header of 'size' bytes, rounded up
+// to headerBlock.
+func blockLength(size int) uint32 {
+	return uint32((size + headerBlock - 1) / headerBlock * headerBlock)
+}
+
+func headerBackupPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+headerBackupExt)
+}
+
+// withBackupHint adds to err, an error opening the header of the file at
+// path, that an interrupted header change left a backup of the previous header.
+func withBackupHint(path string, err error) error {
+	backupPath := headerBackupPath(path)
+	if _, serr := os.Stat(backupPath); serr != nil {
+		return err
+	}
+	return fmt.Errorf("%w\na change of its header was interrupted, the previous one is in %s: 'ghoji slot add', 'ghoji slot remove' or 'ghoji rekey' on the file put it back first", err, backupPath)
+}
+
+// rewriteHeader writes header at the start of the file at path, which must
+// already hold a header of the same length. The old one is saved to the backup
+// first and the backup is removed once the new one is synced.
+func rewriteHeader(path string, header []byte) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("unable to open %s\nerr:%s", path, err)
+	}
+	defer file.Close()
+
+	old := make([]byte, len(header))
+	if _, err := file.ReadAt(old, 0); err != nil {
+		return fmt.Errorf("unable to read the header of %s\nerr:%s", path, err)
+	}
+
+	backupPath := headerBackupPath(path)
+	backup, err := CreateAtomic(backupPath, path, true)
+	if err != nil {
+		return fmt.Errorf("unable to create %s\nerr:%s", backupPath, err)
+	}
+	defer backup.Abort()
+	if _, err := backup.Write(old); err != nil {
+		return fmt.Errorf("unable to write %s\nerr:%s", backupPath, err)
+	}
+	if err := backup.Commit(); err != nil {
+		return fmt.Errorf("unable to write %s\nerr:%s", backupPath, err)
+	}
+
+	if _, err := file.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("unable to write the header of %s, the old one is in %s\nerr:%s", path, backupPath, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync %s, the old header is in %s\nerr:%s", path, backupPath, err)
+	}
+	os.Remove(backupPath)
+	return syncDir(filepath.Dir(path))
+}
+
+// rewriteFile writes header followed by the chunks of the file at path, which
+// start at dataOffset, to a temporary file that replaces it.
+func rewriteFile(path string, header []byte, dataOffset int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open %s\nerr:%s", path, err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to read %s\nerr:%s", path, err)
+	}
+
+	out, err := CreateAtomic(path, "", true)
+	if err != nil {
+		return fmt.Errorf("unable to create the new %s\nerr:%s", path, err)
+	}
+	defer out.Abort()
+	out.Chmod(info.Mode().Perm())
+
+	if _, err := out.Write(header); err != nil {
+		return fmt.Errorf("unable to write the new %s\nerr:%s", path, err)
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(src, dataOffset, info.Size()-dataOffset)); err != nil {
+		return fmt.Errorf("unable to copy the chunks of %s\nerr:%s", path, err)
+	}
+	return out.Commit()
+}
+
+// recoverHeader deals with the backup of a header rewrite that did not
+// complete: if the header of the file opens with keys the rewrite went
+// through and the backup is removed, if the backup opens it is put back.
+func recoverHeader(path string, backupPath string, keys keyring) error {
+	opens := func(r io.Reader) bool {
+		header, err := ReadHeader(r)
+		if err != nil {
+			return false
+		}
+		_, err = keys.open(header)
+		return err == nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("unable to open %s\nerr:%s", path, err)
+	}
+	defer file.Close()
+	if opens(file) {
+		os.Remove(backupPath)
+		return nil
+	}
+
+	backup, err := os.ReadFile(backupPath)
+	if err != nil {
+		return fmt.Errorf("unable to read %s\nerr:%s", backupPath, err)
+	}
+	if !opens(bytes.NewReader(backup)) {
+		return fmt.Errorf("neither the header of %s nor its backup %s can be opened", path, backupPath)
+	}
+	if _, err := file.WriteAt(backup, 0); err != nil {
+		return fmt.Errorf("unable to restore the header of %s from %s\nerr:%s", path, backupPath, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("unable to restore the header of %s from %s\nerr:%s", path, backupPath, err)
+	}
+	os.Remove(backupPath)
+	return nil
+}
@@ -0,0 +1,480 @@
+package encryptor
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// sealed is the outcome of encrypting or decrypting one chunk in the pipeline.
+type sealed struct {
+	data []byte
+	err  error
+}
+
+// chunkJob is a chunk waiting for a worker of the pipeline, which sends the
+// outcome on res.
+type chunkJob struct {
+	index int
+	data  []byte
+	ad    []byte
+	res   chan sealed
+}
+
+// Writer encrypts everything written to it into dst, using the same chunked
+// format as GhojiFile.Encrypt. Since the plaintext size is not known in advance
+// the header is marked with FlagStream and the end of the data is given by the
+// final chunk flag.
+// A fixed pool of Workers goroutines (DefaultGoRoutines when not set, fewer if
+// needed to stay within MaxMemory bytes) seals the chunks in parallel; their
+// results are written to dst in order. Archive sets FlagArchive in the header.
+// ChunkSize is the size of the plaintext chunks, DefaultChunkSize when not set,
+// and Cipher seals them, DefaultCipher when not set. With Recipients the chunks
+// are sealed with a random file key wrapped for each of them, and the password
+// is not used (see X25519Recipient). Keyfile, the hash of a keyfile, is mixed
+// with the password (see ReadKeyfile). KDF, Workers, MaxMemory, Archive,
+// ChunkSize, Cipher, Recipients and Keyfile can be changed before the first
+// Write.
+// Close must be called to flush the last chunk, or CloseWithError when the
+// data is not complete.
+type Writer struct {
+	KDF       KDFParams
+	Workers   int
+	MaxMemory int64
+	Archive   bool
+	ChunkSize int
+	Cipher    CipherID
+
+	Recipients []*X25519Recipient
+	Keyfile    []byte
+
+	dst      io.Writer
+	password []byte
+
+	// sized writers know the plaintext size in advance, which goes in the
+	// header instead of FlagStream (see newSizedWriter)
+	sized     bool
+	plainSize int64
+	written   int64
+
+	started bool
+	closed  bool
+	key     [32]byte
+	aead    cipher.AEAD
+	header  *Header
+	buf     []byte
+	index   int
+
+	plain  *bufferPool
+	sealed *bufferPool
+	jobs   chan chunkJob
+	queue  chan chan sealed
+	done   chan struct{}
+	mu     sync.Mutex
+	err    error
+}
+
+// NewWriter returns a Writer encrypting to dst with a key derived from password.
+func NewWriter(dst io.Writer, password []byte) *Writer {
+	return &Writer{
+		dst:      dst,
+		password: password,
+	}
+}
+
+// newSizedWriter returns a Writer for exactly plainSize bytes, whose output is
+// laid out as the one of GhojiFile.Encrypt. Close fails if a different amount
+// was written.
+func newSizedWriter(dst io.Writer, password []byte, plainSize int64) *Writer {
+	w := NewWriter(dst, password)
+	w.sized = true
+	w.plainSize = plainSize
+	return w
+}
+
+func (w *Writer) setErr(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+}
+
+func (w *Writer) getErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// begin starts w on its first use. An error of start is kept: every later
+// call returns it.
+func (w *Writer) begin() error {
+	if !w.started {
+		w.started = true
+		if err := w.start(); err != nil {
+			w.setErr(err)
+		}
+	}
+	return w.getErr()
+}
+
+// start derives the key, writes the header and launches the workers and the
+// goroutine that writes the sealed chunks in order.
+func (w *Writer) start() error {
+	if w.ChunkSize == 0 {
+		w.ChunkSize = DefaultChunkSize
+	}
+	if w.ChunkSize < MinChunkSize || w.ChunkSize > MaxChunkSize {
+		return fmt.Errorf("invalid chunk size %d, it must be between %d and %d bytes", w.ChunkSize, MinChunkSize, MaxChunkSize)
+	}
+
+	if w.Cipher == 0 {
+		w.Cipher = DefaultCipher
+	}
+	if !w.Cipher.supported() {
+		return fmt.Errorf("unsupported cipher %s", w.Cipher)
+	}
+
+	var err error
+	if len(w.Recipients) > 0 {
+		w.header, w.key, err = newRecipientHeader(0, w.ChunkSize, w.Cipher, w.Recipients)
+		if err != nil {
+			return fmt.Errorf("unable to wrap the file key\nerr:%s", err)
+		}
+	} else {
+		w.header, w.key, err = newPasswordHeader(0, w.ChunkSize, w.Cipher, w.password, w.Keyfile, w.KDF)
+		if err != nil {
+			return fmt.Errorf("unable to wrap the file key\nerr:%s", err)
+		}
+	}
+
+	w.aead, err = w.Cipher.newAEAD(w.header.chunkKey(w.key))
+	if err != nil {
+		return fmt.Errorf("unable to set up %s\nerr:%s", w.Cipher, err)
+	}
+
+	if w.sized {
+		w.header.PlainSize = uint64(w.plainSize)
+	} else {
+		w.header.Flags |= FlagStream
+	}
+	if w.Archive {
+		w.header.Flags |= FlagArchive
+	}
+	w.header.seal(w.key)
+	if _, err := w.dst.Write(w.header.Marshal()); err != nil {
+		return err
+	}
+
+	workers := chunkWorkers(w.Workers, w.MaxMemory, w.ChunkSize)
+	w.plain = newBufferPool(w.ChunkSize, workers+1)
+	w.sealed = newBufferPool(w.header.EncChunkSize(), workers+1)
+	w.buf = w.plain.get()[:0]
+	w.jobs = make(chan chunkJob, workers)
+	w.queue = make(chan chan sealed, workers)
+	w.done = make(chan struct{})
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range w.jobs {
+				enc, err := encryptBuffer(w.sealed.get(), w.aead, job.data, job.ad)
+				w.plain.put(job.data)
+				job.res <- sealed{enc, err}
+			}
+		}()
+	}
+
+	go func() {
+		for res := range w.queue {
+			r := <-res
+			if r.err == nil && w.getErr() == nil {
+				_, r.err = w.dst.Write(r.data)
+			}
+			if r.err != nil {
+				w.setErr(r.err)
+			}
+			w.sealed.put(r.data)
+		}
+		close(w.done)
+	}()
+
+	return nil
+}
+
+// dispatch hands the buffered chunk to the workers. It blocks while Workers
+// chunks are already in flight.
+func (w *Writer) dispatch(final bool) {
+	res := make(chan sealed, 1)
+	w.queue <- res
+	w.jobs <- chunkJob{w.index, w.buf, w.header.chunkAD(w.index, final), res}
+	w.index++
+	w.buf = nil
+	if !final {
+		w.buf = w.plain.get()[:0]
+	}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("write on closed writer")
+	}
+	if err := w.begin(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once we know it is not the last one
+		if len(w.buf) == w.ChunkSize {
+			w.dispatch(false)
+		}
+		c := copy(w.buf[len(w.buf):w.ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	w.written += int64(n)
+
+	return n, nil
+}
+
+// Close seals the final chunk and waits for every chunk to be written. It does
+// not close dst.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.getErr()
+	}
+	w.closed = true
+	w.begin()
+
+	if w.sized && w.written != w.plainSize {
+		w.setErr(fmt.Errorf("%d bytes written instead of %d", w.written, w.plainSize))
+	}
+	if w.getErr() == nil {
+		w.dispatch(true)
+	}
+	w.wait()
+
+	return w.getErr()
+}
+
+// CloseWithError stops w without sealing the final chunk: the chunks not yet
+// written are discarded, and what was written is a stream a Reader reports as
+// truncated rather than a shorter valid one. It is meant for an input that
+// failed or an interrupted run, err being the reason, which is returned (or
+// the first error of w). A nil err stands for ErrAborted. It does not close
+// dst.
+func (w *Writer) CloseWithError(err error) error {
+	if err == nil {
+		err = ErrAborted
+	}
+	if w.closed {
+		return w.getErr()
+	}
+	w.closed = true
+	w.setErr(err)
+	w.wait()
+	return w.getErr()
+}
+
+// wait stops the workers once the chunks in flight are done and waits for the
+// last one to be written. Once w has an error nothing more is written.
+func (w *Writer) wait() {
+	// nothing was launched by a start that failed, or by none
+	if w.jobs == nil {
+		return
+	}
+	close(w.jobs)
+	close(w.queue)
+	<-w.done
+}
+
+// Reader decrypts a stream produced by Writer or GhojiFile.Encrypt. Headerless
+// legacy files are accepted too. A fixed pool of Workers goroutines
+// (DefaultGoRoutines when not set, fewer if needed to stay within MaxMemory
+// bytes) opens the chunks in parallel ahead of the consumer.
+// The header is read on the first call to Read; an error such as
+// ErrWrongPassword is reported there. Files encrypted to recipients are opened
+// with Identities instead of the password, and Keyfile is the hash of the
+// keyfile needed with it, if any. They can be set before the first Read as
+// Workers and MaxMemory.
+type Reader struct {
+	Workers    int
+	MaxMemory  int64
+	Identities []*X25519Identity
+	Keyfile    []byte
+
+	src      *bufio.Reader
+	password []byte
+	fileKey  *[32]byte
+
+	started bool
+	header  *Header
+	plain   *bufferPool
+	cur     []byte
+	curBuf  []byte
+	read    uint64
+	queue   chan chan sealed
+	stop    chan struct{}
+	err     error
+}
+
+// NewReader returns a Reader decrypting src with a key derived from password.
+func NewReader(src io.Reader, password []byte) *Reader {
+	return &Reader{
+		src:      bufio.NewReaderSize(src, enc_chunkSize),
+		password: password,
+	}
+}
+
+// Header returns the header of the stream, nil before the first Read or for
+// legacy files.
+func (r *Reader) Header() *Header {
+	return r.header
+}
+
+func (r *Reader) start() error {
+	r.started = true
+
+	key := sha256.Sum256(r.password)
+	suite := CipherAES256GCM
+	plainChunkSize := chunkSize
+	encChunkSize := enc_chunkSize
+
+	peek, _ := r.src.Peek(len(magic))
+	if string(peek) == magic {
+		header, err := ReadHeader(r.src)
+		if err != nil {
+			return err
+		}
+		key, err = keyring{password: r.password, keyfile: r.Keyfile, identities: r.Identities, fileKey: r.fileKey}.open(header)
+		if err != nil {
+			return err
+		}
+		r.header = header
+		plainChunkSize = int(header.ChunkSize)
+		encChunkSize = header.EncChunkSize()
+		suite = header.Cipher
+	}
+
+	aead, err := suite.newAEAD(r.header.chunkKey(key))
+	if err != nil {
+		return fmt.Errorf("unable to set up %s\nerr:%s", suite, err)
+	}
+
+	workers := chunkWorkers(r.Workers, r.MaxMemory, plainChunkSize)
+	encPool := newBufferPool(encChunkSize, workers+1)
+	r.plain = newBufferPool(plainChunkSize, workers+1)
+	jobs := make(chan chunkJob, workers)
+	r.queue = make(chan chan sealed, workers)
+	r.stop = make(chan struct{})
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				plain, err := decryptBuffer(r.plain.get(), aead, job.data, job.ad)
+				encPool.put(job.data)
+				if err != nil {
+					err = fmt.Errorf("%w: chunk %d failed authentication", ErrCorrupted, job.index)
+				}
+				job.res <- sealed{plain, err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(r.queue)
+		defer close(jobs)
+		for index := 0; ; index++ {
+			buffer := encPool.get()
+			n, err := io.ReadFull(r.src, buffer)
+			if err == io.EOF && (r.header == nil || index > 0) {
+				return
+			}
+
+			res := make(chan sealed, 1)
+			select {
+			case r.queue <- res:
+			case <-r.stop:
+				return
+			}
+
+			if err != nil && err != io.ErrUnexpectedEOF {
+				if err == io.EOF {
+					err = fmt.Errorf("%w: no chunk after the header", ErrCorrupted)
+				}
+				res <- sealed{nil, err}
+				return
+			}
+
+			// the chunk is the last one when nothing follows it
+			_, peekErr := r.src.Peek(1)
+			final := peekErr == io.EOF
+			var ad []byte
+			if r.header != nil {
+				ad = r.header.chunkAD(index, final)
+			}
+
+			jobs <- chunkJob{index, buffer[:n], ad, res}
+
+			if final {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if !r.started {
+		r.err = r.start()
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	for len(r.cur) == 0 {
+		if r.curBuf != nil {
+			r.plain.put(r.curBuf)
+			r.curBuf = nil
+		}
+		res, ok := <-r.queue
+		if !ok {
+			if r.header != nil && r.header.Flags&FlagStream == 0 && r.read != r.header.PlainSize {
+				r.err = fmt.Errorf("%w: expected %d bytes, got %d", ErrCorrupted, r.header.PlainSize, r.read)
+			} else {
+				r.err = io.EOF
+			}
+			return 0, r.err
+		}
+		s := <-res
+		if s.err != nil {
+			r.err = s.err
+			r.Close()
+			return 0, r.err
+		}
+		r.cur = s.data
+		r.curBuf = s.data
+		r.read += uint64(len(s.data))
+	}
+
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close stops the chunks read ahead. It does not close the source.
+func (r *Reader) Close() error {
+	if r.stop != nil {
+		select {
+		case <-r.stop:
+		default:
+			close(r.stop)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package encryptor
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestWriterCloseWithError(t *testing.T) {
+	failure := errors.New("the input failed")
+	tests := []struct {
+		name string
+		size int
+		err  error
+		want error
+	}{
+		{"after some chunks", 2*MinChunkSize + 100, failure, failure},
+		{"on a chunk boundary", 2 * MinChunkSize, failure, failure},
+		{"before the first chunk", 100, failure, failure},
+		{"without a reason", MinChunkSize + 100, nil, ErrAborted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := NewWriter(&out, testPassword)
+			w.KDF = testKDF
+			w.ChunkSize = MinChunkSize
+			if _, err := w.Write(randomData(t, tt.size)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := w.CloseWithError(tt.err); !errors.Is(err, tt.want) {
+				t.Fatalf("CloseWithError = %v, want %v", err, tt.want)
+			}
+			if err := w.Close(); !errors.Is(err, tt.want) {
+				t.Fatalf("Close after CloseWithError = %v, want %v", err, tt.want)
+			}
+
+			// what was written must not pass for a shorter complete stream
+			r := NewReader(bytes.NewReader(out.Bytes()), testPassword)
+			defer r.Close()
+			if _, err := io.ReadAll(r); !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("Read = %v, want %v", err, ErrCorrupted)
+			}
+		})
+	}
+}
+
+func TestWriterCloseWithErrorUnstarted(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, testPassword)
+	if err := w.CloseWithError(nil); !errors.Is(err, ErrAborted) {
+		t.Fatalf("CloseWithError = %v, want %v", err, ErrAborted)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("%d bytes written by a Writer never started", out.Len())
+	}
+}
+
+// failingWriter fails every write, as a full disk does.
+type failingWriter struct{}
+
+var errDstFailed = errors.New("no space left on device")
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errDstFailed
+}
+
+func TestWriterStartFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		dst       io.Writer
+		chunkSize int
+		want      error
+	}{
+		{"failing dst", failingWriter{}, MinChunkSize, errDstFailed},
+		{"invalid chunk size", io.Discard, MinChunkSize - 1, nil},
+	}
+
+	for _, tt := range tests {
+		for _, abort := range []bool{false, true} {
+			name := tt.name + " then Close"
+			if abort {
+				name = tt.name + " then CloseWithError"
+			}
+			t.Run(name, func(t *testing.T) {
+				w := NewWriter(tt.dst, testPassword)
+				w.KDF = testKDF
+				w.ChunkSize = tt.chunkSize
+
+				_, startErr := w.Write(randomData(t, 100))
+				if startErr == nil || (tt.want != nil && !errors.Is(startErr, tt.want)) {
+					t.Fatalf("Write = %v, want %v", startErr, tt.want)
+				}
+				if _, err := w.Write(randomData(t, 100)); err != startErr {
+					t.Fatalf("second Write = %v, want %v", err, startErr)
+				}
+
+				var err error
+				if abort {
+					err = w.CloseWithError(nil)
+				} else {
+					err = w.Close()
+				}
+				if err != startErr {
+					t.Fatalf("close = %v, want %v", err, startErr)
+				}
+			})
+		}
+	}
+}
+
+func TestWriterCloseFailure(t *testing.T) {
+	w := NewWriter(failingWriter{}, testPassword)
+	w.KDF = testKDF
+	if err := w.Close(); !errors.Is(err, errDstFailed) {
+		t.Fatalf("Close = %v, want %v", err, errDstFailed)
+	}
+	if err := w.CloseWithError(nil); !errors.Is(err, errDstFailed) {
+		t.Fatalf("CloseWithError after Close = %v, want %v", err, errDstFailed)
+	}
+}
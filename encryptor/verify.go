@@ -0,0 +1,79 @@
+package encryptor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Verify is VerifyContext without a way to stop it and without progress.
+func Verify(path string, password []byte, keyfile []byte, identities []*X25519Identity) error {
+	return VerifyContext(context.Background(), path, password, keyfile, identities, nil)
+}
+
+// VerifyContext checks that the encrypted file at path is intact and that
+// password, and keyfile when not nil, are right (or that one of identities
+// opens it), without writing the plaintext anywhere: the header and
+// every chunk are authenticated in parallel, as GhojiFile.Decrypt would do,
+// and the plaintext is thrown away.
+// When chunks are corrupted the error is a *ChunkErrors, whose first element
+// is the first bad chunk. 'progress', if not nil, receives the advancement as a
+// fraction and is closed at the end.
+func VerifyContext(ctx context.Context, path string, password []byte, keyfile []byte, identities []*X25519Identity, progress chan<- float32) error {
+	runtime.GOMAXPROCS(MaxCPUs)
+	if progress != nil {
+		defer close(progress)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open %s\nerr:%s", path, err)
+	}
+	defer file.Close()
+
+	l, err := openLayout(file, path, keyring{password: password, keyfile: keyfile, identities: identities})
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return interrupted(ctx, path)
+	}
+
+	// runChunks calls done from several workers
+	var mu sync.Mutex
+	counter := 0
+	done := func() {}
+	if progress != nil {
+		progress <- 0
+		done = func() {
+			mu.Lock()
+			counter++
+			progress <- float32(counter) / float32(l.numChunks)
+			mu.Unlock()
+		}
+	}
+
+	workers := chunkWorkers(DefaultGoRoutines, 0, l.plainChunkSize)
+	errs := runChunks(ctx, l.numChunks, workers, l.plainChunkSize, l.encChunkSize, func(index int, plain []byte, enc []byte) *ChunkError {
+		offset, size, ad := l.chunk(index)
+		buffer := enc[:size]
+		if _, err := file.ReadAt(buffer, offset); err != nil && err != io.EOF {
+			return &ChunkError{index, offset, fmt.Errorf("unable to read\nerr: %s", err)}
+		}
+		if _, err := decryptBuffer(plain, l.aead, buffer, ad); err != nil {
+			return &ChunkError{index, offset, fmt.Errorf("%w: %s", ErrCorrupted, err)}
+		}
+		return nil
+	}, done)
+
+	if err := newChunkErrors(path, errs); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return interrupted(ctx, path)
+	}
+	return nil
+}
@@ -2,7 +2,10 @@ module ghoji
 
 go 1.22.3
 
-require github.com/urfave/cli/v2 v2.27.2
+require (
+	github.com/urfave/cli/v2 v2.27.2
+	golang.org/x/crypto v0.23.0
+)
 
 require golang.org/x/sys v0.20.0 // indirect
 
@@ -0,0 +1,116 @@
+package graphic
+
+import (
+	"context"
+	"fmt"
+	"ghoji/compressor"
+	"ghoji/encryptor"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// doArchiveEncryption tars and compresses the directory at path straight into
+// the encrypting writer, so the result is a single .ji file and no plaintext
+// ever touches the disk.
+func doArchiveEncryption(ctx context.Context, path string, passwd []byte, opts Options) error {
+	fmt.Fprintf(os.Stderr, "Archiving and encrypting dir: %s \n%s\n", path, keyNote(opts))
+
+	var out io.Writer = os.Stdout
+	var atomic *encryptor.AtomicFile
+	if opts.Output != StdStream {
+		created := encryptor.ResolveOutput(path, opts.Output, encryptor.EncryptedName(path))
+		f, err := encryptor.CreateAtomic(created, path, opts.Force)
+		if err != nil {
+			return fmt.Errorf("unable to create %s\nerr: %s", created, err)
+		}
+		atomic = f
+		out = f
+	}
+
+	w := encryptor.NewWriter(out, passwd)
+	w.KDF = opts.KDF
+	w.Workers = opts.Chunks
+	w.ChunkSize = opts.ChunkSize
+	w.Cipher = opts.Cipher
+	w.Recipients = opts.Recipients
+	w.Keyfile = opts.Keyfile
+	w.Archive = true
+
+	progress := make(chan float64)
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		for p := range progress {
+			fmt.Fprint(os.Stderr, "\r")
+			fmt.Fprintf(os.Stderr, "Progress: %d %%", int(p*100))
+		}
+		wg.Done()
+	}()
+
+	err := compressor.WriteArchive(ctxWriter{ctx, w}, path, compressor.DefaultCompresissionLevel, progress)
+	wg.Wait()
+	// an archive cut short must not end in a final chunk
+	if err != nil {
+		w.CloseWithError(err)
+	} else {
+		err = w.Close()
+	}
+	err = finishStream(atomic, err)
+	if err == nil && atomic != nil {
+		fmt.Fprintln(os.Stderr, "\n\nEncrypted archive:", atomic.Path())
+	}
+	return err
+}
+
+// doArchiveDecryption decrypts an archive produced by doArchiveEncryption and
+// extracts it in a directory, without writing the archive itself to disk. The
+// files are extracted in a hidden temporary directory, moved into place only
+// once the whole archive has been authenticated.
+func doArchiveDecryption(ctx context.Context, path string, passwd []byte, opts Options) error {
+	outDir := encryptor.ResolveOutput(path, opts.Output, encryptor.DecryptedName(path))
+	fmt.Fprintf(os.Stderr, "Decrypting and extracting archive: %s \nto dir: %s\n", path, outDir)
+
+	if _, err := os.Stat(outDir); err == nil && !opts.Force {
+		return fmt.Errorf("%s: %w", outDir, encryptor.ErrOutputExists)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outDir), 0755); err != nil {
+		return err
+	}
+	tmpDir, err := encryptor.CreateTempDir(outDir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	r := encryptor.NewReader(&progressReader{r: file, size: info.Size()}, passwd)
+	r.Identities = opts.Identities
+	r.Keyfile = opts.Keyfile
+	r.Workers = opts.Chunks
+	defer r.Close()
+
+	err = compressor.ExtractArchive(ctxReader{ctx, r}, tmpDir)
+	if err == nil {
+		// the tar stream can end before the last chunk has been authenticated
+		_, err = io.Copy(io.Discard, r)
+	}
+	if err != nil {
+		return err
+	}
+
+	return encryptor.CommitDir(tmpDir, outDir, opts.Force)
+}
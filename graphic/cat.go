@@ -0,0 +1,54 @@
+package graphic
+
+import (
+	"context"
+	"fmt"
+	"ghoji/encryptor"
+	"io"
+	"os"
+)
+
+// DoCat runs the cat command: it writes to stdout 'length' bytes of the
+// plaintext of the encrypted file at path, starting at 'offset'. A negative
+// length means up to the end. Only the chunks covering the range are
+// decrypted. The file is opened with identities, or with the password read
+// from password when there are none; keyfile is the hash of the keyfile going
+// with it, if any.
+func DoCat(ctx context.Context, path string, keyfile []byte, password PasswordSource, identities []*encryptor.X25519Identity, offset int64, length int64) error {
+	if offset < 0 {
+		return fmt.Errorf("the offset cannot be negative")
+	}
+	if !password.isPrompt() && len(identities) > 0 {
+		return fmt.Errorf("%s cannot be used with --identity, no password is needed", password.flag)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open %s\nerr: %s", path, err)
+	}
+	defer file.Close()
+
+	// with identities no password is asked
+	var passwd []byte
+	if len(identities) == 0 {
+		passwd, err = password.read(ctx, keyfile != nil)
+		if err != nil {
+			return fmt.Errorf("unable to read the password\nerr: %s", err)
+		}
+	}
+
+	r, err := encryptor.OpenReaderAt(file, passwd, keyfile, identities)
+	if err != nil {
+		return err
+	}
+
+	if offset > r.Size() {
+		return fmt.Errorf("the offset %d is past the end of the plaintext (%d bytes)", offset, r.Size())
+	}
+	if length < 0 || length > r.Size()-offset {
+		length = r.Size() - offset
+	}
+
+	_, err = io.Copy(os.Stdout, ctxReader{ctx, io.NewSectionReader(r, offset, length)})
+	return err
+}
@@ -0,0 +1,34 @@
+package graphic
+
+import (
+	"fmt"
+	"ghoji/encryptor"
+	"os"
+)
+
+// DoCleanup removes (or only lists, with dryRun) the temporary files left in
+// the tree at path by runs that were interrupted. It returns an error if the
+// tree could not be cleaned.
+func DoCleanup(path string, dryRun bool) error {
+	var orphans []string
+	var err error
+	if dryRun {
+		orphans, err = encryptor.FindOrphans(path, true)
+	} else {
+		orphans, err = encryptor.RemoveOrphans(path, true)
+	}
+
+	for _, p := range orphans {
+		fmt.Println(p)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to clean %s\nerr: %s", path, err)
+	}
+
+	verb := "Removed"
+	if dryRun {
+		verb = "Found"
+	}
+	fmt.Fprintf(os.Stderr, "%s %d leftovers of interrupted runs\n", verb, len(orphans))
+	return nil
+}
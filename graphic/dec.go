@@ -1,169 +1,179 @@
 package graphic
 
 import (
+	"context"
 	"fmt"
 	"ghoji/encryptor"
+	"os"
 	"sync"
 	"time"
 )
 
-func DoDecryption(path string, numCpu int, chunks int, maxfiles int) {
-	encryptor.DefaultGoRoutines = chunks
-	encryptor.DefaultMaxFiles = maxfiles
-	encryptor.MaxCPUs = numCpu
-	passwd, err := readPassword()
-	if err != nil {
-		fmt.Printf("unable to read the password\nerr: %s", err)
-		return
+// DoDecryption runs the decrypt command, see DoEncryption.
+func DoDecryption(ctx context.Context, path string, opts Options) error {
+	encryptor.DefaultGoRoutines = opts.Chunks
+	encryptor.DefaultMaxFiles = opts.MaxFiles
+	encryptor.MaxCPUs = opts.NumCpu
+	if opts.MaxMemory > 0 {
+		encryptor.MaxMemory = int64(opts.MaxMemory) * 1024 * 1024
+	}
+
+	if path == StdStream && opts.Output == "" {
+		return fmt.Errorf("reading from stdin needs an --output")
+	}
+
+	isDir := false
+	if path != StdStream {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("unable to read %s\nerr: %s", path, err)
+		}
+		isDir = info.IsDir()
+	}
+	if isDir && opts.Output == StdStream {
+		return fmt.Errorf("a directory cannot be written to stdout")
+	}
+
+	if opts.RemoveSource && (path == StdStream || opts.Output == StdStream) {
+		return fmt.Errorf("--remove-source works only with files and directories, not with streams")
+	}
+	if opts.Resume && (path == StdStream || opts.Output == StdStream) {
+		return fmt.Errorf("--resume works only with files and directories, not with streams")
+	}
+	archive := !isDir && path != StdStream && opts.Output != StdStream && isArchive(path)
+	if opts.Resume && archive {
+		return fmt.Errorf("--resume works only with files and directories, not with archives")
+	}
+	if (opts.RemoveSource || opts.Verify) && archive {
+		return fmt.Errorf("--remove-source and --verify work only with files and directories, not with archives")
+	}
+
+	if !opts.Password.isPrompt() && len(opts.Identities) > 0 {
+		return fmt.Errorf("%s cannot be used with --identity, no password is needed", opts.Password.flag)
+	}
+	if opts.Password.usesStdin() && path == StdStream {
+		return fmt.Errorf("the password cannot be read from stdin while the data is")
+	}
+
+	sweepOrphans(path, isDir, opts.Output, encryptor.DecryptedName)
+
+	// with identities no password is asked
+	var passwd []byte
+	if len(opts.Identities) == 0 {
+		var err error
+		passwd, err = opts.Password.read(ctx, opts.Keyfile != nil)
+		if err != nil {
+			return fmt.Errorf("unable to read the password\nerr: %s", err)
+		}
 	}
 
 	startTime := time.Now()
 
+	if isDir {
+		err := doDirDecryption(ctx, path, passwd, opts)
+		fmt.Fprintln(os.Stderr, "\nElapsed time:", time.Since(startTime))
+		return err
+	}
+
+	// archives are extracted back into a directory
+	if archive {
+		if err := doArchiveDecryption(ctx, path, passwd, opts); err != nil {
+			fmt.Fprint(os.Stderr, "\n\n")
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "\n\nElapsed time:", time.Since(startTime))
+		return nil
+	}
+
+	if path == StdStream || opts.Output == StdStream {
+		fmt.Fprintf(os.Stderr, "Decrypting %s to %s\n", streamName(path, "stdin"), streamName(opts.Output, "stdout"))
+		err := streamDecryption(ctx, path, passwd, opts)
+		if err != nil {
+			fmt.Fprint(os.Stderr, "\n\n")
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "\n\nElapsed time:", time.Since(startTime))
+		return nil
+	}
+
 	file := encryptor.GhojiFile{
 		FilePath:     path,
+		Output:       opts.Output,
+		Overwrite:    opts.Force,
+		RemoveSource: opts.RemoveSource,
+		Verify:       opts.Verify,
+		Resume:       opts.Resume,
 		New_filePath: "",
 		Password:     passwd,
+		Keyfile:      opts.Keyfile,
+		Identities:   opts.Identities,
 		Progress:     make(chan float32),
 		Faults:       nil,
 	}
 
-	fmt.Printf("Decrypting file: %s \nwith %d CPUs and %d goroutines\n", path, numCpu, chunks)
+	fmt.Fprintf(os.Stderr, "Decrypting file: %s \nwith %d CPUs and up to %d chunks in %d MiB\n", path, opts.NumCpu, opts.Chunks, encryptor.MaxMemory/(1024*1024))
 
 	var wg sync.WaitGroup
 
 	wg.Add(1)
 	go func() {
 		for p := range file.Progress {
-			fmt.Print("\r")
-			fmt.Printf("Progress: %d %%", int(p*100))
+			fmt.Fprint(os.Stderr, "\r")
+			fmt.Fprintf(os.Stderr, "Progress: %d %%", int(p*100))
 		}
 		wg.Done()
 	}()
 
-	file.Decrypt()
+	file.DecryptContext(ctx)
 	wg.Wait()
 
 	if file.Faults != nil {
-		fmt.Println("\n\n" + file.Faults.Error())
-		err = file.Rollback()
-		if err != nil {
-			fmt.Println("IMPOSSIBLE TO ROLLBACK")
+		fmt.Fprint(os.Stderr, "\n\n")
+		printFault(file.Faults)
+		if file.Partial != "" {
+			fmt.Fprintln(os.Stderr, "The output written so far is kept, run again with --resume to continue where it stopped")
 		}
-		return
+		return fileFailed(ctx, "decrypt", path)
 	}
 
 	elapsedTime := time.Since(startTime)
-	fmt.Println("\n\nElapsed time:", elapsedTime)
+	fmt.Fprintln(os.Stderr, "\nDecrypted file:", file.New_filePath)
+	fmt.Fprintln(os.Stderr, "\nElapsed time:", elapsedTime)
+	return nil
 }
 
-// func DoDecryption(path string, numCpu int, chunks int, maxfiles int) {
-
-// 	errors := ghojierrors.GetErrorHandler()
-
-// 	info, err := os.Stat(path)
-// 	if err != nil {
-// 		errors <- &ghojierrors.InfoFileError{Path: path, Error: err}
-// 		close(errors)
-// 		return
-// 	}
-
-// 	passwd, err := readPassword()
-// 	if err != nil {
-// 		errors <- &ghojierrors.ReadPasswordError{Error: err}
-// 		close(errors)
-// 		return
-// 	}
-
-// 	startTime := time.Now()
-// 	if info.IsDir() {
-
-// 		fmt.Printf("Decrypting dir: %s \nwith %d CPUs, %d files per time, %d chunks each file per time\n", path, numCpu, maxfiles, chunks)
-
-// 		// getting files
-// 		fmt.Println("Crawling files...")
-// 		files, err := crawlFiles(path)
-// 		if err != nil {
-// 			errors <- &ghojierrors.CrawlingFilesError{Path: path, Error: err}
-// 			close(errors)
-// 			return
-// 		}
-// 		fmt.Printf("\rCrawled %d files\n\n", len(files))
-
-// 		// start parallelism
-// 		var wg sync.WaitGroup
-
-// 		progress_channel := make(chan int)
-
-// 		wg.Add(1)
-// 		go func() {
-// 			sum := 0
-// 			for p := range progress_channel {
-// 				sum += p
-// 				fmt.Print("\r")
-// 				fmt.Printf("Progress: %d / %d ", sum, len(files))
-// 			}
-// 			wg.Done()
-// 		}()
-
-// 		//do decryption
-// 		encryptor.DecryptMultipleFiles(passwd, files, numCpu, chunks, progress_channel, maxfiles, errors)
-// 		wg.Wait()
-
-// 	} else {
-
-// 		fmt.Printf("Decrypting file: %s \nwith %d CPUs and %d goroutines\n", path, numCpu, chunks)
-
-// 		progress := make(chan float64)
-// 		var wg sync.WaitGroup
-
-// 		wg.Add(1)
-// 		go func() {
-// 			for p := range progress {
-// 				fmt.Print("\r")
-// 				fmt.Printf("Progress: %d %%", int(p*100))
-// 			}
-// 			wg.Done()
-// 		}()
-
-// 		newpath := encryptor.DecryptFile(passwd, path, numCpu, chunks, progress, errors)
-// 		wg.Wait()
-
-// 		if newpath == "" {
-// 			close(progress)
-// 			close(errors)
-// 			return
-// 		}
-
-// 		if filepath.Ext(newpath) == ".zst" {
-// 			newname := filepath.Base(newpath)
-// 			filename := newname[:len(newname)-len(".zst")]
-// 			decompressedPath := filepath.Join(filepath.Dir(newpath), filename)
-
-// 			progress := make(chan float64)
-// 			var wg sync.WaitGroup
-
-// 			fmt.Printf("\nFound a compressed dir.. \n")
-// 			wg.Add(1)
-// 			go func() {
-// 				for p := range progress {
-// 					fmt.Print("\r")
-// 					fmt.Printf("Progress: %d %%", int(p*100))
-// 				}
-// 				wg.Done()
-// 			}()
-
-// 			err = compressor.DecompressDirectory(newpath, decompressedPath, progress)
-// 			if err != nil {
-// 				errors <- &ghojierrors.DecompressionError{Path: newpath, Error: err}
-// 				close(errors)
-// 				return
-// 			}
-
-// 			wg.Wait()
-// 			fmt.Printf("\n\nDecompressed\n")
-// 		}
-// 	}
-// 	close(errors)
-// 	elapsedTime := time.Since(startTime)
-// 	fmt.Println("\n\nElapsed time:", elapsedTime)
-// }
+func doDirDecryption(ctx context.Context, path string, passwd []byte, opts Options) error {
+	fmt.Fprintf(os.Stderr, "Decrypting dir: %s \nwith %d CPUs, %d files per time, %d chunks each file per time in %d MiB overall\n", path, opts.NumCpu, opts.MaxFiles, opts.Chunks, encryptor.MaxMemory/(1024*1024))
+
+	// getting files
+	fmt.Fprintln(os.Stderr, "Crawling files...")
+	paths, err := crawlFiles(path)
+	if err != nil {
+		return fmt.Errorf("unable to crawl %s\nerr: %s", path, err)
+	}
+
+	var files []*encryptor.GhojiFile
+	for _, p := range paths {
+		if !encryptor.IsGhojiFile(p) {
+			continue
+		}
+		output, err := dirOutput(path, p, opts.Output)
+		if err != nil {
+			return fmt.Errorf("unable to prepare the output of %s\nerr: %s", p, err)
+		}
+		files = append(files, &encryptor.GhojiFile{
+			FilePath:     p,
+			Output:       output,
+			Overwrite:    opts.Force,
+			RemoveSource: opts.RemoveSource,
+			Verify:       opts.Verify,
+			Resume:       opts.Resume,
+			Password:     passwd,
+			Keyfile:      opts.Keyfile,
+			Identities:   opts.Identities,
+		})
+	}
+	fmt.Fprintf(os.Stderr, "\rCrawled %d files, %d are encrypted\n\n", len(paths), len(files))
+
+	return runFiles(ctx, files, opts.MaxFiles, encryptor.DecryptMultipleFilesContext, "Decrypted")
+}
@@ -1,171 +1,226 @@
 package graphic
 
 import (
+	"context"
 	"fmt"
 	"ghoji/encryptor"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
 
-func DoEncryption(path string, numCpu int, chunks int, maxfiles int, compress bool) {
+// DoEncryption runs the encrypt command. Cancelling ctx interrupts it, leaving
+// nothing behind but the outputs already complete. It returns an error if the
+// run failed, was interrupted, or any file of a directory could not be
+// encrypted.
+func DoEncryption(ctx context.Context, path string, opts Options) error {
+
+	encryptor.DefaultGoRoutines = opts.Chunks
+	encryptor.DefaultMaxFiles = opts.MaxFiles
+	encryptor.MaxCPUs = opts.NumCpu
+	if opts.MaxMemory > 0 {
+		encryptor.MaxMemory = int64(opts.MaxMemory) * 1024 * 1024
+	}
 
-	encryptor.DefaultGoRoutines = chunks
-	encryptor.DefaultMaxFiles = maxfiles
-	encryptor.MaxCPUs = numCpu
-	passwd, err := readPassword()
-	if err != nil {
-		fmt.Printf("unable to read the password\nerr: %s", err)
-		return
+	if path == StdStream && opts.Output == "" {
+		return fmt.Errorf("reading from stdin needs an --output")
+	}
+
+	isDir := false
+	if path != StdStream {
+		path = filepath.Clean(path)
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("unable to read %s\nerr: %s", path, err)
+		}
+		isDir = info.IsDir()
+	}
+	if isDir && opts.Output == StdStream && !opts.Archive {
+		return fmt.Errorf("a directory can be written to stdout only as an --archive")
+	}
+	if !isDir && opts.Archive {
+		return fmt.Errorf("--archive needs a directory")
+	}
+
+	if opts.RemoveSource && (path == StdStream || opts.Output == StdStream || opts.Archive) {
+		return fmt.Errorf("--remove-source works only with files and directories, not with streams or archives")
+	}
+	if opts.Resume && (path == StdStream || opts.Output == StdStream || opts.Archive) {
+		return fmt.Errorf("--resume works only with files and directories, not with streams or archives")
+	}
+	if opts.Resume && len(opts.Recipients) > 0 {
+		return fmt.Errorf("--resume cannot be used with --recipient, the partial output can only be opened by an identity")
+	}
+	if opts.Keyfile != nil && len(opts.Recipients) > 0 {
+		return fmt.Errorf("--keyfile goes with a password, it cannot be used with --recipient")
+	}
+	if !opts.Password.isPrompt() && len(opts.Recipients) > 0 {
+		return fmt.Errorf("%s cannot be used with --recipient, no password is needed", opts.Password.flag)
+	}
+	if opts.Password.usesStdin() && path == StdStream {
+		return fmt.Errorf("the password cannot be read from stdin while the data is")
+	}
+	if opts.GenerateWords > 0 && len(opts.Recipients) > 0 {
+		return fmt.Errorf("--generate-password cannot be used with --recipient, no password is needed")
+	}
+	if opts.GenerateWords > 0 && !opts.Password.isPrompt() {
+		return fmt.Errorf("--generate-password cannot be used with %s, the password is generated", opts.Password.flag)
+	}
+	if opts.MinStrength < 0 || opts.MinStrength > 4 {
+		return fmt.Errorf("--min-strength goes from 0 (no check) to 4")
+	}
+
+	sweepOrphans(path, isDir, opts.Output, encryptor.EncryptedName)
+
+	// the recipients need no password
+	var passwd []byte
+	if len(opts.Recipients) == 0 {
+		var err error
+		passwd, err = newPassword(ctx, opts)
+		if err != nil {
+			return err
+		}
 	}
 
 	startTime := time.Now()
 
+	if isDir && opts.Archive {
+		if err := doArchiveEncryption(ctx, path, passwd, opts); err != nil {
+			fmt.Fprint(os.Stderr, "\n\n")
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "\nElapsed time:", time.Since(startTime))
+		return nil
+	}
+
+	if isDir {
+		err := doDirEncryption(ctx, path, passwd, opts)
+		fmt.Fprintln(os.Stderr, "\nElapsed time:", time.Since(startTime))
+		return err
+	}
+
+	if path == StdStream || opts.Output == StdStream {
+		fmt.Fprintf(os.Stderr, "Encrypting %s to %s\n%s\n", streamName(path, "stdin"), streamName(opts.Output, "stdout"), keyNote(opts))
+		err := streamEncryption(ctx, path, passwd, opts)
+		if err != nil {
+			fmt.Fprint(os.Stderr, "\n\n")
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "\n\nElapsed time:", time.Since(startTime))
+		return nil
+	}
+
 	file := encryptor.GhojiFile{
 		FilePath:     path,
+		Output:       opts.Output,
+		Overwrite:    opts.Force,
+		RemoveSource: opts.RemoveSource,
+		Verify:       opts.Verify,
+		Resume:       opts.Resume,
 		New_filePath: "",
 		Password:     passwd,
+		Keyfile:      opts.Keyfile,
+		KDF:          opts.KDF,
+		ChunkSize:    opts.ChunkSize,
+		Cipher:       opts.Cipher,
+		Recipients:   opts.Recipients,
 		Progress:     make(chan float32),
 		Faults:       nil,
 	}
 
-	fmt.Printf("Encrypting file: %s \nwith %d CPUs and %d goroutines\n", path, numCpu, chunks)
+	fmt.Fprintf(os.Stderr, "Encrypting file: %s \nwith %d CPUs and up to %d chunks in %d MiB\n%s\n", path, opts.NumCpu, opts.Chunks, encryptor.MaxMemory/(1024*1024), keyNote(opts))
 
 	var wg sync.WaitGroup
 
 	wg.Add(1)
 	go func() {
 		for p := range file.Progress {
-			fmt.Print("\r")
-			fmt.Printf("Progress: %d %%", int(p*100))
+			fmt.Fprint(os.Stderr, "\r")
+			fmt.Fprintf(os.Stderr, "Progress: %d %%", int(p*100))
 		}
 		wg.Done()
 	}()
 
-	file.Encrypt()
+	file.EncryptContext(ctx)
 	wg.Wait()
 
 	if file.Faults != nil {
-		fmt.Println("\n\n" + file.Faults.Error())
-		err = file.Rollback()
-		if err != nil {
-			fmt.Println("IMPOSSIBLE TO ROLLBACK")
+		fmt.Fprint(os.Stderr, "\n\n")
+		printFault(file.Faults)
+		if file.Partial != "" {
+			fmt.Fprintln(os.Stderr, "The output written so far is kept, run again with --resume to continue where it stopped")
 		}
-		return
+		return fileFailed(ctx, "encrypt", path)
 	}
 
 	elapsedTime := time.Since(startTime)
-	fmt.Println("\n\nElapsed time:", elapsedTime)
+	fmt.Fprintln(os.Stderr, "\nEncrypted file:", file.New_filePath)
+	fmt.Fprintln(os.Stderr, "\nElapsed time:", elapsedTime)
+	return nil
+}
+
+func doDirEncryption(ctx context.Context, path string, passwd []byte, opts Options) error {
+	fmt.Fprintf(os.Stderr, "Encrypting dir: %s \nwith %d CPUs, %d files per time, %d chunks each file per time in %d MiB overall\n%s\n", path, opts.NumCpu, opts.MaxFiles, opts.Chunks, encryptor.MaxMemory/(1024*1024), keyNote(opts))
 
-	// errors := ghojierrors.GetErrorHandler()
-
-	// info, err := os.Stat(path)
-	// if err != nil {
-	// 	errors <- &ghojierrors.InfoFileError{Path: path, Error: err}
-	// 	close(errors)
-	// }
-
-	// passwd, err := readPassword()
-	// if err != nil {
-	// 	errors <- &ghojierrors.ReadPasswordError{Error: err}
-	// 	close(errors)
-	// }
-
-	// startTime := time.Now()
-
-	// if compress {
-	// 	if info.IsDir() {
-
-	// 		fmt.Printf("Starting compression of dir: %s \n", path)
-
-	// 		newname := filepath.Base(path) + ".zst"
-	// 		newpath := filepath.Join(filepath.Dir(path), newname)
-
-	// 		progress := make(chan float64)
-
-	// 		var wg sync.WaitGroup
-
-	// 		wg.Add(1)
-	// 		go func() {
-	// 			for p := range progress {
-	// 				fmt.Print("\r")
-	// 				fmt.Printf("Progress: %d %%", int(p*100))
-	// 			}
-	// 			wg.Done()
-	// 		}()
-
-	// 		err = compressor.CompressDirectory(path, newpath, compressor.DefaultCompresissionLevel, progress)
-	// 		if err != nil {
-	// 			errors <- &ghojierrors.CompressionError{Path: newpath, Error: err}
-	// 			close(errors)
-	// 		}
-
-	// 		wg.Wait()
-	// 		fmt.Printf("\nCompressed in dir: %s \n", path)
-
-	// 		path = newpath
-	// 		info, err = os.Stat(path)
-	// 		if err != nil {
-	// 			errors <- &ghojierrors.InfoFileError{Path: path, Error: err}
-	// 			close(errors)
-	// 		}
-
-	// 	}
-	// }
-
-	// if info.IsDir() {
-
-	// 	fmt.Printf("Encrypting dir: %s \nwith %d CPUs, %d files per time, %d chunks each file per time\n", path, numCpu, maxfiles, chunks)
-
-	// 	// getting files
-	// 	fmt.Println("Crawling files...")
-	// 	files, err := crawlFiles(path)
-	// 	if err != nil {
-	// 		errors <- &ghojierrors.CrawlingFilesError{Path: path, Error: err}
-	// 		close(errors)
-	// 	}
-	// 	fmt.Printf("\rCrawled %d files\n\n", len(files))
-
-	// 	// start parallelism
-	// 	var wg sync.WaitGroup
-
-	// 	progress_channel := make(chan int)
-
-	// 	wg.Add(1)
-	// 	go func() {
-	// 		sum := 0
-	// 		for p := range progress_channel {
-	// 			sum += p
-	// 			fmt.Print("\r")
-	// 			fmt.Printf("Progress: %d / %d ", sum, len(files))
-	// 		}
-	// 		wg.Done()
-	// 	}()
-
-	// 	//do encryption
-	// 	encryptor.EncryptMultipleFiles(passwd, files, numCpu, chunks, progress_channel, maxfiles, errors)
-	// 	wg.Wait()
-
-	// } else {
-
-	// 	fmt.Printf("Encrypting file: %s \nwith %d CPUs and %d goroutines\n", path, numCpu, chunks)
-
-	// 	progress := make(chan float64)
-	// 	var wg sync.WaitGroup
-
-	// 	wg.Add(1)
-	// 	go func() {
-	// 		for p := range progress {
-	// 			fmt.Print("\r")
-	// 			fmt.Printf("Progress: %d %%", int(p*100))
-	// 		}
-	// 		wg.Done()
-	// 	}()
-
-	// 	_ = encryptor.EncryptFile(passwd, path, numCpu, chunks, progress, errors)
-	// 	wg.Wait()
-	// }
-	// close(errors)
-	// elapsedTime := time.Since(startTime)
-	// fmt.Println("\n\nElapsed time:", elapsedTime)
+	// getting files
+	fmt.Fprintln(os.Stderr, "Crawling files...")
+	paths, err := crawlFiles(path)
+	if err != nil {
+		return fmt.Errorf("unable to crawl %s\nerr: %s", path, err)
+	}
 
+	var files []*encryptor.GhojiFile
+	for _, p := range paths {
+		// never encrypt twice the result of a previous run
+		if encryptor.IsGhojiFile(p) {
+			continue
+		}
+		output, err := dirOutput(path, p, opts.Output)
+		if err != nil {
+			return fmt.Errorf("unable to prepare the output of %s\nerr: %s", p, err)
+		}
+		files = append(files, &encryptor.GhojiFile{
+			FilePath:     p,
+			Output:       output,
+			Overwrite:    opts.Force,
+			RemoveSource: opts.RemoveSource,
+			Verify:       opts.Verify,
+			Resume:       opts.Resume,
+			Password:     passwd,
+			Keyfile:      opts.Keyfile,
+			KDF:          opts.KDF,
+			ChunkSize:    opts.ChunkSize,
+			Cipher:       opts.Cipher,
+			Recipients:   opts.Recipients,
+		})
+	}
+	fmt.Fprintf(os.Stderr, "\rCrawled %d files, %d already encrypted are skipped\n\n", len(paths), len(paths)-len(files))
+
+	return runFiles(ctx, files, opts.MaxFiles, encryptor.EncryptMultipleFilesContext, "Encrypted")
+}
+
+// newPassword returns the password of an encryption, generated or read from
+// opts.Password, once checked with checkStrength.
+func newPassword(ctx context.Context, opts Options) ([]byte, error) {
+	if opts.GenerateWords > 0 {
+		passwd, err := generatePassphrase(opts.GenerateWords)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate a password\nerr: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "Generated password:\n\n    %s\n\n", passwd)
+		fmt.Fprintln(os.Stderr, "Write it down: it is not stored anywhere and the files cannot be decrypted without it")
+		fmt.Fprintln(os.Stderr)
+		return passwd, checkStrength(passphraseStrength(opts.GenerateWords), opts)
+	}
+
+	passwd, err := opts.Password.readNew(ctx, opts.Keyfile != nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the password\nerr: %s", err)
+	}
+	// the keyfile makes up for a weak password
+	if opts.Keyfile != nil {
+		return passwd, nil
+	}
+	return passwd, checkStrength(estimateStrength(string(passwd)), opts)
 }
@@ -0,0 +1,115 @@
+package graphic
+
+import (
+	"encoding/json"
+	"fmt"
+	"ghoji/encryptor"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DoInfo runs the info command: it prints what the header of the encrypted
+// file at path tells, or of every encrypted file in the directory at path. No
+// password is needed. With asJSON a JSON object is printed on stdout for a
+// file, an array of them for a directory.
+func DoInfo(path string, asJSON bool) error {
+	path = filepath.Clean(path)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("unable to read %s\nerr: %s", path, err)
+	}
+
+	paths := []string{path}
+	if stat.IsDir() {
+		all, err := crawlFiles(path)
+		if err != nil {
+			return fmt.Errorf("unable to crawl %s\nerr: %s", path, err)
+		}
+		paths = paths[:0]
+		for _, p := range all {
+			if encryptor.IsGhojiFile(p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+
+	var infos []*encryptor.Info
+	failed := 0
+	for _, p := range paths {
+		info, err := encryptor.Inspect(p)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "[!] %s\n", err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if !stat.IsDir() {
+			if len(infos) == 1 {
+				enc.Encode(infos[0])
+			}
+		} else {
+			if infos == nil {
+				infos = []*encryptor.Info{}
+			}
+			enc.Encode(infos)
+		}
+	} else {
+		for i, info := range infos {
+			if i > 0 {
+				fmt.Println()
+			}
+			printInfo(info)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be read", failed, len(paths))
+	}
+	return nil
+}
+
+// printInfo prints an Info for humans.
+func printInfo(info *encryptor.Info) {
+	format := fmt.Sprintf("ghoji v%d", info.Version)
+	if info.Version == 0 {
+		format = "legacy (no header)"
+	}
+	payload := "single file"
+	if info.Payload == encryptor.PayloadArchive {
+		payload = "directory archive"
+	}
+	if info.Streamed {
+		payload += ", streamed"
+	}
+
+	fmt.Printf("File:        %s\n", info.Path)
+	fmt.Printf("Format:      %s\n", format)
+	fmt.Printf("Payload:     %s\n", payload)
+	fmt.Printf("Cipher:      %s\n", info.Cipher)
+	if info.KDF != nil {
+		fmt.Printf("KDF:         %s\n", info.KDF.Summary)
+	}
+	for i, slot := range info.Slots {
+		fmt.Printf("Slot %-2d      %s", i, slot.Type)
+		if slot.Tag != "" {
+			fmt.Printf(" recipient %s", slot.Tag)
+		}
+		if slot.KDF != nil {
+			fmt.Printf(", %s", slot.KDF.Summary)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Chunk size:  %d bytes\n", info.ChunkSize)
+	fmt.Printf("Chunks:      %d\n", info.Chunks)
+	fmt.Printf("Plain size:  %d bytes\n", info.PlainSize)
+	fmt.Printf("File size:   %d bytes\n", info.Size)
+	if info.Created != nil {
+		fmt.Printf("Created:     %s\n", info.Created.Format(time.RFC3339))
+	}
+}
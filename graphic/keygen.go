@@ -0,0 +1,88 @@
+package graphic
+
+import (
+	"fmt"
+	"ghoji/encryptor"
+	"os"
+	"strings"
+)
+
+// DoKeygen runs the keygen command: it generates an X25519 identity and writes
+// it to the file at output, readable by the owner only, or to stdout when
+// output is empty or "-". The public key to encrypt to is printed as well.
+func DoKeygen(output string, force bool) error {
+	identity, err := encryptor.GenerateX25519Identity()
+	if err != nil {
+		return fmt.Errorf("unable to generate the key\nerr: %s", err)
+	}
+
+	if output == "" || output == StdStream {
+		if err := encryptor.WriteIdentity(os.Stdout, identity); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Public key: %s\n", identity.Recipient())
+		return nil
+	}
+
+	out, err := encryptor.CreateAtomic(output, "", force)
+	if err != nil {
+		return fmt.Errorf("unable to create %s\nerr: %s", output, err)
+	}
+	defer out.Abort()
+	if err := encryptor.WriteIdentity(out, identity); err != nil {
+		return fmt.Errorf("unable to write %s\nerr: %s", output, err)
+	}
+	if err := out.Commit(); err != nil {
+		return fmt.Errorf("unable to write %s\nerr: %s", output, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Identity written to %s, keep it secret\n", output)
+	fmt.Printf("Public key: %s\n", identity.Recipient())
+	return nil
+}
+
+// ParseRecipients reads the values of --recipient: public keys, or paths of
+// files holding one per line (blank lines and # comments are skipped).
+func ParseRecipients(values []string) ([]*encryptor.X25519Recipient, error) {
+	var recipients []*encryptor.X25519Recipient
+	for _, v := range values {
+		if _, err := os.Stat(v); err != nil {
+			r, err := encryptor.ParseX25519Recipient(v)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, r)
+			continue
+		}
+
+		data, err := os.ReadFile(v)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s\nerr: %s", v, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			r, err := encryptor.ParseX25519Recipient(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", v, err)
+			}
+			recipients = append(recipients, r)
+		}
+	}
+	return recipients, nil
+}
+
+// ParseIdentities reads the identity files given with --identity.
+func ParseIdentities(paths []string) ([]*encryptor.X25519Identity, error) {
+	var identities []*encryptor.X25519Identity
+	for _, p := range paths {
+		ids, err := encryptor.ReadIdentityFile(p)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, ids...)
+	}
+	return identities, nil
+}
@@ -0,0 +1,51 @@
+package graphic
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"math"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// eff_large_wordlist.txt is the EFF large wordlist for diceware passphrases
+// (https://www.eff.org/dice), one "roll<TAB>word" line for each of the 7776
+// rolls of five dice.
+//
+//go:embed eff_large_wordlist.txt
+var wordlistText string
+
+// wordlist returns the words of the diceware list, each one adding about 12.9
+// bits to a passphrase.
+var wordlist = sync.OnceValue(func() []string {
+	lines := strings.Split(strings.TrimSpace(wordlistText), "\n")
+	words := make([]string, len(lines))
+	for i, line := range lines {
+		_, words[i], _ = strings.Cut(line, "\t")
+	}
+	return words
+})
+
+// generatePassphrase returns n words of the diceware list picked with
+// crypto/rand, joined by '-' so that it needs no quoting in a shell.
+func generatePassphrase(n int) ([]byte, error) {
+	words := wordlist()
+	picked := make([]string, n)
+	for i := range picked {
+		k, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+		if err != nil {
+			return nil, err
+		}
+		picked[i] = words[k.Int64()]
+	}
+	return []byte(strings.Join(picked, "-")), nil
+}
+
+// passphraseStrength is the strength of a passphrase of n words from
+// generatePassphrase, known exactly: the attacker has to try every choice of
+// the words.
+func passphraseStrength(n int) strength {
+	guesses := math.Pow(float64(len(wordlist())), float64(n))
+	return strength{guesses: guesses, score: guessesScore(guesses), hint: "add more words with --words"}
+}
@@ -0,0 +1,167 @@
+package graphic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// PasswordSource is where a password comes from: the terminal prompt, or one
+// of the sources usable without a terminal (cron jobs, CI) given by
+// --password-file, --password-env, --password-fd or --password-command, or by
+// the same flags with a prefix, such as --new-password-file for the new
+// password of a rekey. The zero value is the prompt.
+type PasswordSource struct {
+	kind  string
+	flag  string
+	value string
+	fd    int
+}
+
+// NewPasswordSource returns the source set among file, env, fd (negative when
+// not set) and command, the values of the --<prefix>password-* flags. At most
+// one can be set, none is the prompt.
+func NewPasswordSource(prefix string, file string, env string, fd int, command string) (PasswordSource, error) {
+	source := func(kind string, value string) PasswordSource {
+		return PasswordSource{kind: kind, flag: "--" + prefix + "password-" + kind, value: value}
+	}
+
+	var sources []PasswordSource
+	if file != "" {
+		sources = append(sources, source("file", file))
+	}
+	if env != "" {
+		sources = append(sources, source("env", env))
+	}
+	if fd >= 0 {
+		s := source("fd", fmt.Sprint(fd))
+		s.fd = fd
+		sources = append(sources, s)
+	}
+	if command != "" {
+		sources = append(sources, source("command", command))
+	}
+
+	switch len(sources) {
+	case 0:
+		return PasswordSource{}, nil
+	case 1:
+		return sources[0], nil
+	}
+	return PasswordSource{}, fmt.Errorf("%s and %s cannot be used together, give only one of --%[3]spassword-file, --%[3]spassword-env, --%[3]spassword-fd and --%[3]spassword-command", sources[0].flag, sources[1].flag, prefix)
+}
+
+// isPrompt tells whether the password is typed at the terminal.
+func (s PasswordSource) isPrompt() bool {
+	return s.kind == ""
+}
+
+// usesStdin tells whether the password is read from the standard input, which
+// then cannot carry the data.
+func (s PasswordSource) usesStdin() bool {
+	return s.kind == "fd" && s.fd == 0
+}
+
+// sharesFD tells whether s and o read the same file descriptor: only the first
+// of them would find the password there.
+func (s PasswordSource) sharesFD(o PasswordSource) bool {
+	return s.kind == "fd" && o.kind == "fd" && s.fd == o.fd
+}
+
+// read returns the password: the first line of the file, of what is read from
+// the file descriptor or of the output of the command, or the whole value of
+// the environment variable. An empty password is refused unless allowEmpty
+// (a keyfile is used alone), since it is likely a mistake in a script.
+func (s PasswordSource) read(ctx context.Context, allowEmpty bool) ([]byte, error) {
+	var password []byte
+	var err error
+	switch s.kind {
+	case "":
+		return readPassword(ctx)
+	case "file":
+		var file *os.File
+		file, err = os.Open(s.value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open the password file %s\nerr: %s", s.value, err)
+		}
+		defer file.Close()
+		password, err = firstLine(file)
+	case "env":
+		value, ok := os.LookupEnv(s.value)
+		if !ok {
+			return nil, fmt.Errorf("the environment variable %s is not set", s.value)
+		}
+		// commands run later do not need to see it
+		os.Unsetenv(s.value)
+		password = []byte(value)
+	case "fd":
+		file := os.NewFile(uintptr(s.fd), "password fd")
+		if file == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d", s.fd)
+		}
+		defer file.Close()
+		password, err = firstLine(file)
+	case "command":
+		password, err = runPasswordCommand(ctx, s.value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the password from %s %s\nerr: %s", s.flag, s.value, err)
+	}
+
+	if len(password) == 0 && !allowEmpty {
+		return nil, fmt.Errorf("the password from %s %s is empty", s.flag, s.value)
+	}
+	return password, nil
+}
+
+// readNew returns the password of an encryption, see read: typed at the
+// terminal it is asked twice, the files cannot be opened with a typo.
+func (s PasswordSource) readNew(ctx context.Context, allowEmpty bool) ([]byte, error) {
+	if s.isPrompt() {
+		return confirmPassword(ctx, "Enter password: ", "Repeat password: ")
+	}
+	return s.read(ctx, allowEmpty)
+}
+
+// ask returns the password, see read: typed at the terminal it is asked with
+// prompt.
+func (s PasswordSource) ask(ctx context.Context, prompt string, allowEmpty bool) ([]byte, error) {
+	if s.isPrompt() {
+		return promptPassword(ctx, prompt)
+	}
+	return s.read(ctx, allowEmpty)
+}
+
+// firstLine reads r up to the first newline, which is not part of the line.
+func firstLine(r io.Reader) ([]byte, error) {
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// runPasswordCommand runs command with the shell and returns the first line
+// of its output. Its stderr is the one of ghoji, so that it can ask for
+// anything it needs.
+func runPasswordCommand(ctx context.Context, command string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return firstLine(bytes.NewReader(out))
+}
@@ -0,0 +1,84 @@
+package graphic
+
+import (
+	"context"
+	"fmt"
+	"ghoji/encryptor"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DoRekey runs the rekey command: it changes the password of the encrypted
+// file at path, or of every encrypted file in the directory at path, to a new
+// one derived with kdf. The current and the new password are read from
+// password and newPassword, keyfile and newKeyfile are the hashes of the
+// keyfiles going with them, nil for none. Version 3 files
+// only get their header rewritten, older ones are encrypted again without
+// writing the plaintext to disk. It returns an error if any file could not be
+// changed.
+func DoRekey(ctx context.Context, path string, keyfile []byte, password PasswordSource, newKeyfile []byte, newPassword PasswordSource, kdf encryptor.KDFParams) error {
+	if password.sharesFD(newPassword) {
+		return fmt.Errorf("%s and %s cannot read the same file descriptor", password.flag, newPassword.flag)
+	}
+
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("unable to read %s\nerr: %s", path, err)
+	}
+
+	paths := []string{path}
+	if info.IsDir() {
+		all, err := crawlFiles(path)
+		if err != nil {
+			return fmt.Errorf("unable to crawl %s\nerr: %s", path, err)
+		}
+		paths = paths[:0]
+		for _, p := range all {
+			if encryptor.IsGhojiFile(p) {
+				paths = append(paths, p)
+			}
+		}
+		if len(paths) == 0 {
+			return fmt.Errorf("no encrypted file found in %s", path)
+		}
+	}
+
+	passwd, err := password.ask(ctx, "Enter the current password: ", keyfile != nil)
+	if err != nil {
+		return fmt.Errorf("unable to read the password\nerr: %s", err)
+	}
+	newPasswd, err := readNewPassword(ctx, newPassword, newKeyfile != nil)
+	if err != nil {
+		return fmt.Errorf("unable to read the new password\nerr: %s", err)
+	}
+
+	startTime := time.Now()
+	failed := 0
+	for _, p := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+
+		fmt.Fprintf(os.Stderr, "Changing the password of %s\n", p)
+		if err := encryptor.Rekey(ctx, p, passwd, keyfile, newPasswd, newKeyfile, kdf); err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "[!] %s\n", p)
+			printFault(err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "OK %s\n", p)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nChanged %d/%d files\n", len(paths)-failed, len(paths))
+	fmt.Fprintln(os.Stderr, "\nElapsed time:", time.Since(startTime))
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted: %w", ctx.Err())
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be changed", failed, len(paths))
+	}
+	return nil
+}
@@ -1,25 +1,76 @@
 package graphic
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"ghoji/encryptor"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 
 	"golang.org/x/term"
 )
 
-func crawlFiles(path string) ([]string, error) {
+// Options holds the command line settings of an encryption or a decryption.
+type Options struct {
+	Output string
+	Force  bool
+	// RemoveSource deletes the input once the output is safely in place.
+	RemoveSource bool
+	// Verify decrypts the output again before RemoveSource deletes anything.
+	Verify bool
+	// Resume continues the files left partial by a previous run with Resume.
+	Resume bool
+	NumCpu int
+	// Chunks caps the chunks in flight, which MaxMemory (MiB) bounds.
+	Chunks    int
+	MaxMemory int
+	MaxFiles  int
+	Archive   bool
+	KDF       encryptor.KDFParams
+	// ChunkSize is the size in bytes of the plaintext chunks, 0 for the
+	// default.
+	ChunkSize int
+	Cipher    encryptor.CipherID
+	// Recipients encrypts to public keys instead of a password, Identities
+	// decrypt such files.
+	Recipients []*encryptor.X25519Recipient
+	Identities []*encryptor.X25519Identity
+	// Keyfile is the hash of the keyfile going with the password, nil for none.
+	Keyfile []byte
+	// Password tells where the password is read from.
+	Password PasswordSource
+	// GenerateWords, when set, generates a passphrase of that many diceware
+	// words instead of reading the password.
+	GenerateWords int
+	// MinStrength (0 to 4, 0 for no check) is the strength under which a new
+	// password is warned about, or refused with RefuseWeak. A password going
+	// with a keyfile is not checked.
+	MinStrength int
+	RefuseWeak  bool
+}
+
+func crawlFiles(root string) ([]string, error) {
 
 	var files []string
 
 	// WalkDir the directory tree
-	err := filepath.WalkDir(path, func(path string, d os.DirEntry, err error) error {
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
+		// the temporaries of ghoji itself are never inputs
+		if path != root && encryptor.IsTemporary(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		// If it's a file, add it to the slice
 		if !d.IsDir() {
 			absPath, err := filepath.Abs(path)
@@ -43,15 +94,258 @@ func crawlFiles(path string) ([]string, error) {
 	return files, nil
 }
 
-func readPassword() ([32]byte, error) {
-	fmt.Print("Enter password: ")
-	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+// maxShownChunks is the number of failed chunks listed by printFault.
+const maxShownChunks = 10
+
+// printFault prints the error of a file on stderr. When chunks failed, they
+// are listed with their index and offset.
+func printFault(err error) {
+	var chunks *encryptor.ChunkErrors
+	if !errors.As(err, &chunks) {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: %d chunk(s) failed\n", chunks.Path, len(chunks.Errors))
+	for i, c := range chunks.Errors {
+		if i == maxShownChunks {
+			fmt.Fprintf(os.Stderr, "... and %d more\n", len(chunks.Errors)-i)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "[!] chunk %d at offset %d: %s\n", c.Index, c.Offset, c.Err)
+	}
+}
+
+// sweepOrphans removes the temporary files left by interrupted runs where the
+// outputs of this run are going to be written.
+func sweepOrphans(path string, isDir bool, output string, name func(string) string) {
+	var dir string
+	switch {
+	case output == StdStream:
+		return
+	case isDir && output != "":
+		dir = output
+	case isDir:
+		dir = path
+	case path == StdStream:
+		dir = filepath.Dir(output)
+	default:
+		dir = filepath.Dir(encryptor.ResolveOutput(path, output, name(path)))
+	}
+
+	removed, err := encryptor.RemoveOrphans(dir, isDir)
+	for _, p := range removed {
+		fmt.Fprintf(os.Stderr, "Removed the leftover of an interrupted run: %s\n", p)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "unable to look for leftovers in %s\nerr: %s\n", dir, err)
+	}
+}
+
+// isArchive tells whether the file at path holds a directory archive.
+func isArchive(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header, err := encryptor.ReadHeader(file)
+	return err == nil && header.IsArchive()
+}
+
+// dirOutput returns the Output of a file found crawling 'root'. Without an
+// output directory the file is processed in place, otherwise the tree of root
+// is mirrored under 'output'.
+func dirOutput(root string, file string, output string) (string, error) {
+	if output == "" {
+		return "", nil
+	}
+
+	absRoot, err := filepath.Abs(root)
 	if err != nil {
-		return [32]byte{}, err
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, filepath.Dir(file))
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(output, rel)
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// runFiles runs a multiple files encryption/decryption printing the overall
+// progress, then reports every file that failed. It returns an error if any
+// file failed or the run was interrupted.
+func runFiles(ctx context.Context, files []*encryptor.GhojiFile, maxfiles int, run func(context.Context, []*encryptor.GhojiFile, int, chan<- float32), verb string) error {
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to do")
+		return nil
+	}
+
+	progress := make(chan float32)
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		for p := range progress {
+			fmt.Fprint(os.Stderr, "\r")
+			fmt.Fprintf(os.Stderr, "Progress: %d %%", int(p*100))
+		}
+		wg.Done()
+	}()
+
+	run(ctx, files, maxfiles, progress)
+	wg.Wait()
+
+	failed, interrupted, partial := 0, 0, 0
+	for _, file := range files {
+		if file.Faults == nil {
+			continue
+		}
+		failed++
+		if file.Partial != "" {
+			partial++
+		}
+		// the interrupted files are only counted, they did not go wrong
+		if errors.Is(file.Faults, context.Canceled) {
+			interrupted++
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "\n\n[!] %s\n", file.FilePath)
+		printFault(file.Faults)
+	}
+
+	fmt.Fprintf(os.Stderr, "\n\n%s %d/%d files\n", verb, len(files)-failed, len(files))
+	if interrupted > 0 {
+		fmt.Fprintf(os.Stderr, "Interrupted, %d files were not processed\n", interrupted)
 	}
-	fmt.Printf("\n\n")
-	password := sha256.Sum256(bytePassword)
+	if partial > 0 {
+		fmt.Fprintf(os.Stderr, "%d files were written in part, run again with --resume to continue where they stopped\n", partial)
+	}
+
+	if interrupted > 0 {
+		return fmt.Errorf("interrupted: %w", ctx.Err())
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(files))
+	}
+	return nil
+}
+
+// fileFailed is the error returned once the fault of the file at path has
+// been printed: the interruption, or the failure to 'verb' it.
+func fileFailed(ctx context.Context, verb string, path string) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted: %w", ctx.Err())
+	}
+	return fmt.Errorf("unable to %s %s", verb, path)
+}
+
+// ParseKeyfile reads the value of --keyfile: nil when not set, the hash of the
+// keyfile otherwise (see encryptor.ReadKeyfile).
+func ParseKeyfile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return encryptor.ReadKeyfile(path)
+}
 
+// readPassword prompts for the password of the files, see promptPassword.
+func readPassword(ctx context.Context) ([]byte, error) {
+	return promptPassword(ctx, "Enter password: ")
+}
+
+// readNewPassword returns the new password of a rekey or of a slot from
+// source, asked twice when typed at the terminal, see confirmPassword.
+func readNewPassword(ctx context.Context, source PasswordSource, allowEmpty bool) ([]byte, error) {
+	if source.isPrompt() {
+		return confirmPassword(ctx, "Enter the new password: ", "Repeat the new password: ")
+	}
+	return source.read(ctx, allowEmpty)
+}
+
+// confirmPassword asks a password with prompt, then again with repeat, so
+// that a typo does not lock the files away.
+func confirmPassword(ctx context.Context, prompt string, repeat string) ([]byte, error) {
+	password, err := promptPassword(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+	again, err := promptPassword(ctx, repeat)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(password, again) {
+		return nil, fmt.Errorf("the passwords do not match")
+	}
 	return password, nil
+}
+
+// promptPassword prints prompt on stderr and reads a password from the
+// terminal. When stdin is not a terminal (ghoji is reading data from a pipe)
+// the password is read from the controlling tty. Cancelling ctx stops the
+// prompt.
+func promptPassword(ctx context.Context, prompt string) ([]byte, error) {
+	fd := int(syscall.Stdin)
+	if !term.IsTerminal(fd) {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return nil, fmt.Errorf("stdin is not a terminal and no tty is available to read the password")
+		}
+		defer tty.Close()
+		fd = int(tty.Fd())
+	}
+
+	// the echo is turned back on if the prompt is interrupted
+	state, err := term.GetState(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		password []byte
+		err      error
+	}
+	read := make(chan result, 1)
+
+	fmt.Fprint(os.Stderr, prompt)
+	go func() {
+		bytePassword, err := term.ReadPassword(fd)
+		read <- result{bytePassword, err}
+	}()
+
+	select {
+	case r := <-read:
+		if r.err != nil {
+			return nil, r.err
+		}
+		fmt.Fprintf(os.Stderr, "\n\n")
+		// an empty password is still a password
+		return append([]byte{}, r.password...), nil
+	case <-ctx.Done():
+		term.Restore(fd, state)
+		return nil, fmt.Errorf("interrupted: %w", ctx.Err())
+	}
+}
 
+// keyNote tells how the keys of the encryption are obtained.
+func keyNote(opts Options) string {
+	if len(opts.Recipients) > 0 {
+		return fmt.Sprintf("Wrapping the keys for %d recipient(s)", len(opts.Recipients))
+	}
+	if opts.Keyfile != nil {
+		return "Deriving the key from the password and the keyfile with " + opts.KDF.String()
+	}
+	return "Deriving the key with " + opts.KDF.String()
+}
+
+// streamName is the name shown to the user for a path given on the command
+// line, 'std' being the standard stream "-" stands for.
+func streamName(path string, std string) string {
+	if path == StdStream {
+		return std
+	}
+	return path
 }
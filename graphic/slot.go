@@ -0,0 +1,117 @@
+package graphic
+
+import (
+	"context"
+	"fmt"
+	"ghoji/encryptor"
+	"os"
+)
+
+// DoSlotList runs the slot list command: it prints the slots of the encrypted
+// file at path, no password is needed.
+func DoSlotList(path string) error {
+	info, err := encryptor.Inspect(path)
+	if err != nil {
+		return err
+	}
+	if len(info.Slots) == 0 {
+		return fmt.Errorf("%s has no slots, its key is derived from the password itself", path)
+	}
+
+	for i, slot := range info.Slots {
+		fmt.Printf("%-3d %-9s", i, slot.Type)
+		if slot.Tag != "" {
+			fmt.Printf(" recipient %s", slot.Tag)
+		}
+		if slot.KDF != nil {
+			fmt.Printf(" %s", slot.KDF.Summary)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// DoSlotAdd runs the slot add command: once the file at path is opened with a
+// current password read from password (and keyfile, the hash of its keyfile),
+// or with one of identities, a slot is added for each of recipients, or for a
+// new password read from newPassword when there are none. The new password is
+// derived with kdf, mixed with newKeyfile if not nil. Only the header of the
+// file is rewritten.
+func DoSlotAdd(ctx context.Context, path string, keyfile []byte, password PasswordSource, identities []*encryptor.X25519Identity, recipients []*encryptor.X25519Recipient, newKeyfile []byte, newPassword PasswordSource, kdf encryptor.KDFParams) error {
+	if !newPassword.isPrompt() && len(recipients) > 0 {
+		return fmt.Errorf("%s cannot be used with --recipient, no new password is needed", newPassword.flag)
+	}
+	if password.sharesFD(newPassword) {
+		return fmt.Errorf("%s and %s cannot read the same file descriptor", password.flag, newPassword.flag)
+	}
+
+	editor, err := openSlots(ctx, path, keyfile, password, identities)
+	if err != nil {
+		return err
+	}
+
+	if len(recipients) > 0 {
+		for _, r := range recipients {
+			if err := editor.AddRecipient(r); err != nil {
+				return err
+			}
+		}
+	} else {
+		passwd, err := readNewPassword(ctx, newPassword, newKeyfile != nil)
+		if err != nil {
+			return fmt.Errorf("unable to read the new password\nerr: %s", err)
+		}
+		if err := editor.AddPassword(passwd, newKeyfile, kdf); err != nil {
+			return err
+		}
+	}
+
+	if err := editor.Save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s has now %d slots\n", path, len(editor.Slots()))
+	return nil
+}
+
+// DoSlotRemove runs the slot remove command: once the file at path is opened
+// with a current password read from password (and keyfile), or with one of
+// identities, the slot 'index' (as listed by slot list) is removed. Only the
+// header of the file is rewritten.
+func DoSlotRemove(ctx context.Context, path string, keyfile []byte, password PasswordSource, identities []*encryptor.X25519Identity, index int) error {
+	editor, err := openSlots(ctx, path, keyfile, password, identities)
+	if err != nil {
+		return err
+	}
+
+	if err := editor.Remove(index); err != nil {
+		return err
+	}
+	if err := editor.Save(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Slot %d removed, %s has now %d slots\n", index, path, len(editor.Slots()))
+	if editor.Opened() < 0 {
+		fmt.Fprintln(os.Stderr, "The removed slot is the one used to open the file now")
+	}
+	fmt.Fprintln(os.Stderr, "Who read the file key before keeps it: re-encrypt the file to revoke that access")
+	return nil
+}
+
+// openSlots opens the slots of the file at path with identities, or with a
+// password read from password and keyfile when there are none.
+func openSlots(ctx context.Context, path string, keyfile []byte, password PasswordSource, identities []*encryptor.X25519Identity) (*encryptor.SlotEditor, error) {
+	if !password.isPrompt() && len(identities) > 0 {
+		return nil, fmt.Errorf("%s cannot be used with --identity, no password is needed", password.flag)
+	}
+
+	var passwd []byte
+	if len(identities) == 0 {
+		var err error
+		passwd, err = password.ask(ctx, "Enter a current password: ", keyfile != nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the password\nerr: %s", err)
+		}
+	}
+	return encryptor.OpenSlots(path, passwd, keyfile, identities)
+}
@@ -0,0 +1,155 @@
+package graphic
+
+import (
+	"context"
+	"fmt"
+	"ghoji/encryptor"
+	"io"
+	"os"
+	"time"
+)
+
+// StdStream is the path that stands for stdin (as input) or stdout (as output).
+const StdStream = "-"
+
+// progressReader counts the bytes flowing through it and prints them on stderr,
+// as a percentage of size when it is known.
+type progressReader struct {
+	r     io.Reader
+	size  int64
+	total int64
+	last  time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.total += int64(n)
+	if time.Since(p.last) > 200*time.Millisecond || err == io.EOF {
+		p.last = time.Now()
+		if p.size > 0 {
+			fmt.Fprintf(os.Stderr, "\rProgress: %d %%", p.total*100/p.size)
+		} else {
+			fmt.Fprintf(os.Stderr, "\rProcessed: %d MB", p.total/(1024*1024))
+		}
+	}
+	return n, err
+}
+
+// ctxReader fails once ctx is cancelled, so that a copy stops at the next read.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, fmt.Errorf("interrupted: %w", err)
+	}
+	return c.r.Read(b)
+}
+
+// ctxWriter is the ctxReader of writes.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c ctxWriter) Write(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, fmt.Errorf("interrupted: %w", err)
+	}
+	return c.w.Write(b)
+}
+
+// openStreams opens the input and output of a streaming run, mapping "-" to
+// stdin and stdout. 'name' gives the default output file name from the input
+// path. 'atomic' is the output file, nil for stdout: it must be committed or
+// aborted with finishStream.
+func openStreams(path string, opts Options, name func(string) string) (in io.ReadCloser, out io.Writer, atomic *encryptor.AtomicFile, err error) {
+	in = os.Stdin
+	if path != StdStream {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("unable to open %s\nerr: %s", path, err)
+		}
+		in = f
+	}
+
+	out = os.Stdout
+	if opts.Output != StdStream {
+		created := opts.Output
+		if path != StdStream {
+			created = encryptor.ResolveOutput(path, opts.Output, name(path))
+		} else if info, err := os.Stat(opts.Output); err == nil && info.IsDir() {
+			in.Close()
+			return nil, nil, nil, fmt.Errorf("reading from stdin needs an output file, %s is a directory", opts.Output)
+		}
+
+		atomic, err = encryptor.CreateAtomic(created, path, opts.Force)
+		if err != nil {
+			in.Close()
+			return nil, nil, nil, fmt.Errorf("unable to create %s\nerr: %s", created, err)
+		}
+		out = atomic
+	}
+
+	return in, out, atomic, nil
+}
+
+// streamEncryption encrypts sequentially from path to opts.Output, either of
+// which can be "-". It is used when ghoji sits in a pipeline.
+func streamEncryption(ctx context.Context, path string, passwd []byte, opts Options) error {
+	in, out, atomic, err := openStreams(path, opts, encryptor.EncryptedName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	w := encryptor.NewWriter(out, passwd)
+	w.KDF = opts.KDF
+	w.Workers = opts.Chunks
+	w.ChunkSize = opts.ChunkSize
+	w.Cipher = opts.Cipher
+	w.Recipients = opts.Recipients
+	w.Keyfile = opts.Keyfile
+
+	// an input cut short must not end in a final chunk
+	_, err = io.Copy(w, &progressReader{r: ctxReader{ctx, in}})
+	if err != nil {
+		w.CloseWithError(err)
+	} else {
+		err = w.Close()
+	}
+	return finishStream(atomic, err)
+}
+
+// streamDecryption is the counterpart of streamEncryption.
+func streamDecryption(ctx context.Context, path string, passwd []byte, opts Options) error {
+	in, out, atomic, err := openStreams(path, opts, encryptor.DecryptedName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r := encryptor.NewReader(in, passwd)
+	r.Identities = opts.Identities
+	r.Keyfile = opts.Keyfile
+	r.Workers = opts.Chunks
+	defer r.Close()
+
+	_, err = io.Copy(out, &progressReader{r: ctxReader{ctx, r}})
+	return finishStream(atomic, err)
+}
+
+// finishStream moves the output file into place if the run succeeded, and
+// removes it otherwise. Nothing is done for stdout.
+func finishStream(atomic *encryptor.AtomicFile, err error) error {
+	if atomic == nil {
+		return err
+	}
+	if err != nil {
+		atomic.Abort()
+		return err
+	}
+	return atomic.Commit()
+}
@@ -0,0 +1,746 @@
+package graphic
+
+import (
+	_ "embed"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//go:embed common_passwords.txt
+var commonPasswordsText string
+
+// strength is how hard a password is to guess, estimated as zxcvbn does: the
+// password is split into the patterns an attacker tries first (common
+// passwords, words, keyboard rows, sequences, repeats, dates), the rest being
+// brute forced, and guesses is the number of guesses of the cheapest split.
+// score goes from 0 (guessed at once) to 4 (out of reach even offline) and
+// hint tells what makes the password weak.
+type strength struct {
+	guesses float64
+	score   int
+	hint    string
+}
+
+// bits is the entropy of the password, the base 2 log of its guesses.
+func (s strength) bits() float64 {
+	return math.Log2(s.guesses)
+}
+
+const (
+	// maxStrengthRunes caps the part of the password that is analysed, the
+	// score of longer ones does not change.
+	maxStrengthRunes = 100
+	// maxWordRunes is the length of the longest word looked up.
+	maxWordRunes = 16
+	// minGuessesBeforeGrowingSequence keeps a split in many short matches from
+	// looking cheaper than a single longer one (from zxcvbn).
+	minGuessesBeforeGrowingSequence = 10000
+	// minYearSpace is the least number of years guessed around now.
+	minYearSpace = 20
+)
+
+// match is a part of the password, the runes from i to j included, matched
+// by pattern and taking guesses to be found.
+type match struct {
+	i, j    int
+	pattern string
+	guesses float64
+	// dictionary matches only
+	rank     int
+	common   bool
+	reversed bool
+	l33t     bool
+}
+
+// rankedWords maps the words known to an attacker to their rank: the common
+// passwords by frequency, then the words of the diceware list, all tried at
+// the rank of the size of the list.
+var rankedWords = sync.OnceValue(func() map[string]int {
+	ranks := make(map[string]int)
+	for _, word := range wordlist() {
+		ranks[word] = len(wordlist())
+	}
+	for i, word := range strings.Fields(commonPasswordsText) {
+		ranks[word] = i + 1
+	}
+	return ranks
+})
+
+var commonPasswords = sync.OnceValue(func() map[string]bool {
+	common := make(map[string]bool)
+	for _, word := range strings.Fields(commonPasswordsText) {
+		common[word] = true
+	}
+	return common
+})
+
+// estimateStrength rates password, see strength.
+func estimateStrength(password string) strength {
+	runes := []rune(password)
+	if len(runes) > maxStrengthRunes {
+		runes = runes[:maxStrengthRunes]
+	}
+
+	guesses, sequence := mostGuessableSequence(runes, map[string]float64{})
+	return strength{
+		guesses: guesses,
+		score:   guessesScore(guesses),
+		hint:    strengthHint(runes, sequence),
+	}
+}
+
+// guessesScore turns guesses into the 0 to 4 score of zxcvbn: below a thousand
+// guesses the password falls to an online attack, above ten billions it
+// withstands an offline one against a slow hash.
+func guessesScore(guesses float64) int {
+	switch {
+	case guesses < 1e3+5:
+		return 0
+	case guesses < 1e6+5:
+		return 1
+	case guesses < 1e8+5:
+		return 2
+	case guesses < 1e10+5:
+		return 3
+	}
+	return 4
+}
+
+// mostGuessableSequence returns the guesses of the cheapest split of runes in
+// matches and the matches of that split. memo holds the guesses of the bases
+// of the repeats already estimated.
+func mostGuessableSequence(runes []rune, memo map[string]float64) (float64, []match) {
+	n := len(runes)
+	if n == 0 {
+		return 1, nil
+	}
+
+	byEnd := make([][]match, n)
+	for _, m := range omnimatch(runes, memo) {
+		// a part of the password is at least a few guesses away
+		if j := m.j - m.i + 1; j < n {
+			if j == 1 {
+				m.guesses = math.Max(m.guesses, 10)
+			} else {
+				m.guesses = math.Max(m.guesses, 50)
+			}
+		}
+		byEnd[m.j] = append(byEnd[m.j], m)
+	}
+
+	// the best split ending at each rune, by number of matches
+	type step struct {
+		m    match
+		pi   float64
+		g    float64
+		l    int
+		prev *step
+	}
+	optimal := make([]map[int]*step, n)
+	for k := range optimal {
+		optimal[k] = make(map[int]*step)
+	}
+
+	update := func(m match, prev *step) {
+		l, pi := 1, m.guesses
+		if prev != nil {
+			l, pi = prev.l+1, prev.pi*m.guesses
+		}
+		g := factorial(l)*pi + math.Pow(minGuessesBeforeGrowingSequence, float64(l-1))
+		for ol, s := range optimal[m.j] {
+			if ol <= l && s.g <= g {
+				return
+			}
+		}
+		optimal[m.j][l] = &step{m: m, pi: pi, g: g, l: l, prev: prev}
+	}
+
+	for k := 0; k < n; k++ {
+		for _, m := range byEnd[k] {
+			if m.i == 0 {
+				update(m, nil)
+				continue
+			}
+			for _, s := range optimal[m.i-1] {
+				update(m, s)
+			}
+		}
+
+		// the runes up to k brute forced, after the best splits before them
+		for i := 0; i <= k; i++ {
+			bf := match{i: i, j: k, pattern: "bruteforce", guesses: bruteforceGuesses(k - i + 1)}
+			if i == 0 {
+				update(bf, nil)
+				continue
+			}
+			for _, s := range optimal[i-1] {
+				// two brute forced runs are one
+				if s.m.pattern == "bruteforce" {
+					continue
+				}
+				update(bf, s)
+			}
+		}
+	}
+
+	var best *step
+	for _, s := range optimal[n-1] {
+		if best == nil || s.g < best.g {
+			best = s
+		}
+	}
+
+	var sequence []match
+	for s := best; s != nil; s = s.prev {
+		sequence = append([]match{s.m}, sequence...)
+	}
+	return best.g, sequence
+}
+
+// omnimatch returns every match of runes by the patterns known.
+func omnimatch(runes []rune, memo map[string]float64) []match {
+	var matches []match
+	matches = append(matches, dictionaryMatches(runes)...)
+	matches = append(matches, spatialMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, repeatMatches(runes, memo)...)
+	matches = append(matches, dateMatches(runes)...)
+	return matches
+}
+
+// bruteforceGuesses is the number of guesses of n runes tried blindly.
+func bruteforceGuesses(n int) float64 {
+	guesses := math.Pow(10, float64(n))
+	if n == 1 {
+		return guesses + 1
+	}
+	return guesses + 1 + 50
+}
+
+// l33tTable lists the letters the symbols commonly stand for.
+var l33tTable = map[rune][]rune{
+	'4': {'a'}, '@': {'a'}, '8': {'b'}, '(': {'c'}, '{': {'c'}, '[': {'c'}, '<': {'c'},
+	'3': {'e'}, '6': {'g'}, '9': {'g'}, '1': {'i', 'l'}, '!': {'i'}, '|': {'i', 'l'},
+	'0': {'o'}, '$': {'s'}, '5': {'s'}, '7': {'t'}, '+': {'t'}, '%': {'x'}, '2': {'z'},
+}
+
+// dictionaryMatches finds the known words in runes, also reversed or spelled
+// with symbols for letters, in any case.
+func dictionaryMatches(runes []rune) []match {
+	ranks := rankedWords()
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	var matches []match
+	for i := range lower {
+		for j := i + 2; j < len(lower) && j-i < maxWordRunes; j++ {
+			part := lower[i : j+1]
+			cased := upperVariations(runes[i : j+1])
+
+			word := string(part)
+			if rank, ok := ranks[word]; ok {
+				matches = append(matches, match{i: i, j: j, pattern: "dictionary", rank: rank, common: commonPasswords()[word],
+					guesses: float64(rank) * cased})
+			}
+
+			reversed := string(reverseRunes(part))
+			if rank, ok := ranks[reversed]; ok && reversed != word {
+				matches = append(matches, match{i: i, j: j, pattern: "dictionary", rank: rank, common: commonPasswords()[reversed], reversed: true,
+					guesses: float64(rank) * cased * 2})
+			}
+
+			for alt := 0; alt < 2; alt++ {
+				unl33t, subs := translateL33t(part, alt)
+				if subs == nil {
+					break
+				}
+				if rank, ok := ranks[unl33t]; ok {
+					matches = append(matches, match{i: i, j: j, pattern: "dictionary", rank: rank, common: commonPasswords()[unl33t], l33t: true,
+						guesses: float64(rank) * cased * l33tVariations(part, subs)})
+				}
+			}
+		}
+	}
+	return matches
+}
+
+// translateL33t replaces the symbols of part with the letters they stand
+// for, the alt-th one when there are more. subs maps each symbol replaced to
+// its letter, nil when there are none.
+func translateL33t(part []rune, alt int) (string, map[rune]rune) {
+	var subs map[rune]rune
+	out := make([]rune, len(part))
+	for i, r := range part {
+		letters, ok := l33tTable[r]
+		if !ok {
+			out[i] = r
+			continue
+		}
+		if subs == nil {
+			subs = make(map[rune]rune)
+		}
+		letter := letters[min(alt, len(letters)-1)]
+		subs[r] = letter
+		out[i] = letter
+	}
+	return string(out), subs
+}
+
+// l33tVariations is the number of ways the symbols could have been put in
+// the word: for each letter, the ways of choosing the replaced ones.
+func l33tVariations(part []rune, subs map[rune]rune) float64 {
+	variations := 1.0
+	for symbol, letter := range subs {
+		s, u := 0, 0
+		for _, r := range part {
+			switch r {
+			case symbol:
+				s++
+			case letter:
+				u++
+			}
+		}
+		if u == 0 {
+			// every letter is replaced: the symbols or the letters
+			variations *= 2
+			continue
+		}
+		sum := 0.0
+		for i := 1; i <= min(s, u); i++ {
+			sum += binomial(s+u, i)
+		}
+		variations *= sum
+	}
+	return variations
+}
+
+// upperVariations is the number of ways the upper case letters of part could
+// have been chosen: the usual ones (the first, the last or all) are few.
+func upperVariations(part []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range part {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+	if upper == 0 {
+		return 1
+	}
+	if lower == 0 || unicode.IsUpper(part[0]) && upper == 1 || unicode.IsUpper(part[len(part)-1]) && upper == 1 {
+		return 2
+	}
+	sum := 0.0
+	for i := 1; i <= min(upper, lower); i++ {
+		sum += binomial(upper+lower, i)
+	}
+	return sum
+}
+
+// qwertyRows is the layout of the keys for the spatial patterns, with the
+// shifted keys in qwertyShifted. Each row starts further right than the one
+// above it, by qwertyOffsets keys.
+var (
+	qwertyRows    = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./"}
+	qwertyShifted = []string{"~!@#$%^&*()_+", "QWERTYUIOP{}|", "ASDFGHJKL:\"", "ZXCVBNM<>?"}
+	qwertyOffsets = []float64{0, 1.5, 1.75, 2.25}
+)
+
+// keyPosition is where a key is on the keyboard.
+type keyPosition struct {
+	row     int
+	x       float64
+	shifted bool
+}
+
+var qwerty = sync.OnceValue(func() map[rune]keyPosition {
+	keys := make(map[rune]keyPosition)
+	for row := range qwertyRows {
+		for col, r := range qwertyRows[row] {
+			keys[r] = keyPosition{row: row, x: float64(col) + qwertyOffsets[row]}
+		}
+		for col, r := range qwertyShifted[row] {
+			keys[r] = keyPosition{row: row, x: float64(col) + qwertyOffsets[row], shifted: true}
+		}
+	}
+	return keys
+})
+
+// adjacentKeys tells whether the keys at a and b are next to each other.
+func adjacentKeys(a, b keyPosition) bool {
+	switch a.row - b.row {
+	case 0:
+		return math.Abs(a.x-b.x) == 1
+	case 1, -1:
+		return math.Abs(a.x-b.x) < 1
+	}
+	return false
+}
+
+// qwertyDegree is the average number of neighbours of a key.
+var qwertyDegree = sync.OnceValue(func() float64 {
+	var keys []keyPosition
+	for _, k := range qwerty() {
+		if !k.shifted {
+			keys = append(keys, k)
+		}
+	}
+	edges := 0
+	for _, a := range keys {
+		for _, b := range keys {
+			if adjacentKeys(a, b) {
+				edges++
+			}
+		}
+	}
+	return float64(edges) / float64(len(keys))
+})
+
+// spatialMatches finds the runs of at least three keys next to each other on
+// the keyboard, like qwerty or zaq1.
+func spatialMatches(runes []rune) []match {
+	keys := qwerty()
+	var matches []match
+	for i := 0; i < len(runes); {
+		j := i
+		turns, shifted := 0, 0
+		lastDir := [2]float64{}
+		if k, ok := keys[runes[i]]; ok && k.shifted {
+			shifted++
+		}
+		for j+1 < len(runes) {
+			a, okA := keys[runes[j]]
+			b, okB := keys[runes[j+1]]
+			if !okA || !okB || !adjacentKeys(a, b) {
+				break
+			}
+			dir := [2]float64{float64(b.row - a.row), b.x - a.x}
+			if dir != lastDir {
+				turns++
+				lastDir = dir
+			}
+			if b.shifted {
+				shifted++
+			}
+			j++
+		}
+		if j-i >= 2 {
+			matches = append(matches, match{i: i, j: j, pattern: "spatial", guesses: spatialGuesses(j-i+1, turns, shifted)})
+		}
+		i = max(j, i+1)
+	}
+	return matches
+}
+
+// spatialGuesses is the number of guesses of a keyboard pattern of n keys
+// changing direction turns times, shifted of them with shift.
+func spatialGuesses(n int, turns int, shifted int) float64 {
+	starts := float64(len(qwerty()) / 2)
+	degree := qwertyDegree()
+	guesses := 0.0
+	for i := 2; i <= n; i++ {
+		for j := 1; j <= min(turns, i-1); j++ {
+			guesses += binomial(i-1, j-1) * starts * math.Pow(degree, float64(j))
+		}
+	}
+
+	if shifted > 0 {
+		unshifted := n - shifted
+		if unshifted == 0 {
+			guesses *= 2
+		} else {
+			sum := 0.0
+			for i := 1; i <= min(shifted, unshifted); i++ {
+				sum += binomial(shifted+unshifted, i)
+			}
+			guesses *= sum
+		}
+	}
+	return guesses
+}
+
+// sequenceMatches finds the runs of at least three runes going up or down by
+// the same small step, like abc, 2468 or zyx.
+func sequenceMatches(runes []rune) []match {
+	var matches []match
+	for i := 0; i+1 < len(runes); {
+		delta := runes[i+1] - runes[i]
+		if delta == 0 || delta > 5 || delta < -5 {
+			i++
+			continue
+		}
+		j := i + 1
+		for j+1 < len(runes) && runes[j+1]-runes[j] == delta {
+			j++
+		}
+		if j-i >= 2 {
+			matches = append(matches, match{i: i, j: j, pattern: "sequence", guesses: sequenceGuesses(runes[i:j+1], delta < 0)})
+		}
+		i = j
+	}
+	return matches
+}
+
+// sequenceGuesses is the number of guesses of the sequence part: its start
+// (the obvious ones first), its direction and its length.
+func sequenceGuesses(part []rune, descending bool) float64 {
+	base := 26.0
+	switch {
+	case strings.ContainsRune("aAzZ019", part[0]):
+		base = 4
+	case unicode.IsDigit(part[0]):
+		base = 10
+	}
+	if descending {
+		base *= 2
+	}
+	return base * float64(len(part))
+}
+
+// repeatMatches finds the runes repeated at least three times, like aaa, and
+// the groups repeated at least twice, like abcabc. A repeat takes the guesses
+// of its base times the number of repetitions.
+func repeatMatches(runes []rune, memo map[string]float64) []match {
+	var matches []match
+	for i := range runes {
+		for size := 1; i+2*size <= len(runes); size++ {
+			base := runes[i : i+size]
+			count := 1
+			for i+(count+1)*size <= len(runes) && string(runes[i+count*size:i+(count+1)*size]) == string(base) {
+				count++
+			}
+			if count < 2 || count*size < 3 {
+				continue
+			}
+
+			key := string(base)
+			guesses, ok := memo[key]
+			if !ok {
+				guesses, _ = mostGuessableSequence(base, memo)
+				memo[key] = guesses
+			}
+			matches = append(matches, match{i: i, j: i + count*size - 1, pattern: "repeat", guesses: guesses * float64(count)})
+		}
+	}
+	return matches
+}
+
+// dateMatches finds the years and the dates, with or without separators,
+// like 1987, 12/05/1990 or 20011231.
+func dateMatches(runes []rune) []match {
+	now := time.Now().Year()
+	var matches []match
+	for i := range runes {
+		for j := i + 3; j < len(runes) && j-i < 10; j++ {
+			year, separated, ok := parseDate(runes[i : j+1])
+			if !ok {
+				continue
+			}
+			space := math.Max(math.Abs(float64(year-now)), minYearSpace)
+			guesses := space
+			// a year alone is four digits, a date has a day and a month too
+			if j-i+1 > 4 || separated {
+				guesses *= 365
+			}
+			if separated {
+				guesses *= 4
+			}
+			matches = append(matches, match{i: i, j: j, pattern: "date", guesses: guesses})
+		}
+	}
+	return matches
+}
+
+// parseDate reads part as a year, or a date with the year first or last and
+// the day and the month in any order, optionally separated by one of the
+// usual separators. It returns the year and whether there were separators.
+func parseDate(part []rune) (year int, separated bool, ok bool) {
+	s := string(part)
+	if len(part) == 4 && allDigits(s) {
+		year = atoi(s)
+		return year, false, year >= 1900 && year <= 2099
+	}
+
+	if allDigits(s) {
+		return parseDateDigits(s)
+	}
+
+	var fields []string
+	for _, sep := range []string{"/", "-", ".", " ", "_", "\\"} {
+		if strings.Count(s, sep) == 2 {
+			fields = strings.Split(s, sep)
+			break
+		}
+	}
+	if len(fields) != 3 {
+		return 0, false, false
+	}
+	for _, f := range fields {
+		if f == "" || !allDigits(f) {
+			return 0, false, false
+		}
+	}
+	year, ok = dateYear(fields[0], fields[1], fields[2])
+	return year, true, ok
+}
+
+// parseDateDigits tries every split of the digits of s in a day, a month and
+// a year of two or four digits.
+func parseDateDigits(s string) (int, bool, bool) {
+	if len(s) < 4 || len(s) > 8 {
+		return 0, false, false
+	}
+	for a := 1; a < len(s)-1; a++ {
+		for b := a + 1; b < len(s); b++ {
+			if year, ok := dateYear(s[:a], s[a:b], s[b:]); ok {
+				return year, false, true
+			}
+		}
+	}
+	return 0, false, false
+}
+
+// dateYear returns the year of the date made of the fields a, b and c, the
+// year being the first or the last one.
+func dateYear(a, b, c string) (int, bool) {
+	for _, order := range [][3]string{{c, a, b}, {c, b, a}, {a, b, c}, {a, c, b}} {
+		y, d, m := order[0], order[1], order[2]
+		if len(y) != 2 && len(y) != 4 || len(d) > 2 || len(m) > 2 {
+			continue
+		}
+		year, day, month := atoi(y), atoi(d), atoi(m)
+		if len(y) == 2 {
+			// two digits years are the closest to now
+			if year < 50 {
+				year += 2000
+			} else {
+				year += 1900
+			}
+		}
+		if year >= 1000 && year <= 2099 && day >= 1 && day <= 31 && month >= 1 && month <= 12 {
+			return year, true
+		}
+	}
+	return 0, false
+}
+
+// strengthHint tells what makes the password weakest: the longest known
+// pattern of sequence, or its length when it is brute forced.
+func strengthHint(runes []rune, sequence []match) string {
+	var longest *match
+	words := 0
+	for k := range sequence {
+		m := &sequence[k]
+		if m.pattern == "dictionary" && !m.common {
+			words++
+		}
+		if m.pattern != "bruteforce" && (longest == nil || m.j-m.i > longest.j-longest.i) {
+			longest = m
+		}
+	}
+
+	if longest == nil {
+		if len(runes) < 12 {
+			return "it is short, add a few more words or characters"
+		}
+		return "add a few more words or characters"
+	}
+
+	switch longest.pattern {
+	case "dictionary":
+		switch {
+		case longest.common && longest.rank <= 10:
+			return "it is one of the 10 most common passwords"
+		case longest.common:
+			return "it is a common password"
+		case longest.reversed || longest.l33t:
+			return "reversed words and symbols for letters like @ for a are tried early"
+		case words > 1:
+			return "words are guessed as a whole, add more of them"
+		}
+		return "a single word is easy to guess, add more words"
+	case "spatial":
+		return "rows of keys and short keyboard patterns are easy to guess"
+	case "repeat":
+		return "repeats like aaa or abcabc are easy to guess"
+	case "sequence":
+		return "sequences like abc or 6543 are easy to guess"
+	case "date":
+		return "dates and years are easy to guess"
+	}
+	return "add a few more words or characters"
+}
+
+// checkStrength warns on stderr when the score of s is below
+// opts.MinStrength, or with opts.RefuseWeak returns an error. A MinStrength of
+// 0 turns the check off.
+func checkStrength(s strength, opts Options) error {
+	if opts.MinStrength <= 0 || s.score >= opts.MinStrength {
+		return nil
+	}
+
+	weak := fmt.Sprintf("the password is weak: strength %d/4 (about %.0f bits), %s", s.score, s.bits(), s.hint)
+	advice := "--generate-password makes a strong one"
+	if opts.GenerateWords > 0 {
+		advice = "a lower --min-strength accepts it"
+	}
+	if opts.RefuseWeak {
+		return fmt.Errorf("%s\n%s", weak, advice)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %s. %s\n\n", weak, advice)
+	return nil
+}
+
+func reverseRunes(runes []rune) []rune {
+	out := make([]rune, len(runes))
+	for i, r := range runes {
+		out[len(runes)-1-i] = r
+	}
+	return out
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// atoi reads the digits of s, which are checked by allDigits.
+func atoi(s string) int {
+	n := 0
+	for _, r := range s {
+		n = n*10 + int(r-'0')
+	}
+	return n
+}
+
+func factorial(n int) float64 {
+	f := 1.0
+	for i := 2; i <= n; i++ {
+		f *= float64(i)
+	}
+	return f
+}
+
+func binomial(n, k int) float64 {
+	if k < 0 || k > n {
+		return 0
+	}
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+	return r
+}
@@ -0,0 +1,104 @@
+package graphic
+
+import (
+	"context"
+	"fmt"
+	"ghoji/encryptor"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DoVerify runs the verify command: it checks the encrypted file at path, or
+// every encrypted file in the directory at path, without writing any
+// plaintext. The files are opened with opts.Identities, or with the password
+// read from opts.Password when there are none. It returns an error if
+// any file is damaged or the password is wrong for it, so that scripts can
+// rely on the exit status.
+func DoVerify(ctx context.Context, path string, opts Options) error {
+	encryptor.DefaultGoRoutines = opts.Chunks
+	encryptor.MaxCPUs = opts.NumCpu
+	if opts.MaxMemory > 0 {
+		encryptor.MaxMemory = int64(opts.MaxMemory) * 1024 * 1024
+	}
+
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("unable to read %s\nerr: %s", path, err)
+	}
+
+	paths := []string{path}
+	if info.IsDir() {
+		all, err := crawlFiles(path)
+		if err != nil {
+			return fmt.Errorf("unable to crawl %s\nerr: %s", path, err)
+		}
+		paths = paths[:0]
+		for _, p := range all {
+			if encryptor.IsGhojiFile(p) {
+				paths = append(paths, p)
+			}
+		}
+		if len(paths) == 0 {
+			return fmt.Errorf("no encrypted file found in %s", path)
+		}
+	}
+
+	if !opts.Password.isPrompt() && len(opts.Identities) > 0 {
+		return fmt.Errorf("%s cannot be used with --identity, no password is needed", opts.Password.flag)
+	}
+
+	// with identities no password is asked
+	var passwd []byte
+	if len(opts.Identities) == 0 {
+		passwd, err = opts.Password.read(ctx, opts.Keyfile != nil)
+		if err != nil {
+			return fmt.Errorf("unable to read the password\nerr: %s", err)
+		}
+	}
+
+	startTime := time.Now()
+	failed := 0
+	for _, p := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+
+		fmt.Fprintf(os.Stderr, "Verifying %s\n", p)
+		progress := make(chan float32)
+		var wg sync.WaitGroup
+
+		wg.Add(1)
+		go func() {
+			for p := range progress {
+				fmt.Fprint(os.Stderr, "\r")
+				fmt.Fprintf(os.Stderr, "Progress: %d %%", int(p*100))
+			}
+			wg.Done()
+		}()
+
+		err := encryptor.VerifyContext(ctx, p, passwd, opts.Keyfile, opts.Identities, progress)
+		wg.Wait()
+
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "\n[!] %s\n", p)
+			printFault(err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "\nOK %s\n", p)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nVerified %d/%d files\n", len(paths)-failed, len(paths))
+	fmt.Fprintln(os.Stderr, "\nElapsed time:", time.Since(startTime))
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted: %w", ctx.Err())
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed the verification", failed, len(paths))
+	}
+	return nil
+}
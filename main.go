@@ -1,15 +1,82 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"ghoji/encryptor"
 	"ghoji/graphic"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/urfave/cli/v2"
 )
 
+// exitInterrupted is the exit status of a run stopped by a signal, the one of
+// a shell for a command killed by SIGINT.
+const exitInterrupted = 130
+
+// interruptContext returns a context cancelled on the first SIGINT or SIGTERM,
+// so that the running command can stop and clean up. A second signal kills the
+// process as usual.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		fmt.Fprintln(os.Stderr, "\n\nInterrupting, send the signal again to quit immediately")
+		cancel()
+	}()
+
+	return ctx
+}
+
+// passwordFlags returns the --<prefix>password-* flags telling where 'what'
+// (e.g. "the password") is read from instead of the prompt, see
+// passwordSource.
+func passwordFlags(prefix string, what string) []cli.Flag {
+	exclusive := func(kinds ...string) string {
+		flags := make([]string, len(kinds))
+		for i, kind := range kinds {
+			flags[i] = "--" + prefix + "password-" + kind
+		}
+		return "Mutually exclusive with " + strings.Join(flags[:len(flags)-1], ", ") + " and " + flags[len(flags)-1]
+	}
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  prefix + "password-file",
+			Usage: fmt.Sprintf("Read %s from the first line of this file instead of the prompt, for scripts and cron jobs. Keep the file readable by you only. %s", what, exclusive("env", "fd", "command")),
+		},
+		&cli.StringFlag{
+			Name:  prefix + "password-env",
+			Usage: fmt.Sprintf("Read %s from this environment variable instead of the prompt (the variable is then cleared). %s", what, exclusive("file", "fd", "command")),
+		},
+		&cli.IntFlag{
+			Name:  prefix + "password-fd",
+			Usage: fmt.Sprintf("Read %s from the first line of this open file descriptor instead of the prompt (e.g. 3 with '3<secret'; 0 is stdin, not usable when the data comes from stdin). %s", what, exclusive("file", "env", "command")),
+		},
+		&cli.StringFlag{
+			Name:  prefix + "password-command",
+			Usage: fmt.Sprintf("Run this shell command (e.g. a secrets manager CLI) and use the first line of its output as %s instead of the prompt. %s", what, exclusive("file", "env", "fd")),
+		},
+	}
+}
+
+// passwordSource returns the source of the password set by the
+// --<prefix>password-* flags of the command, the prompt when none is.
+func passwordSource(c *cli.Context, prefix string) (graphic.PasswordSource, error) {
+	fd := -1
+	if c.IsSet(prefix + "password-fd") {
+		fd = c.Int(prefix + "password-fd")
+	}
+	return graphic.NewPasswordSource(prefix, c.String(prefix+"password-file"), c.String(prefix+"password-env"), fd, c.String(prefix+"password-command"))
+}
+
 func main() {
 	app := &cli.App{
 		Name:     "ghoji",
@@ -23,22 +90,43 @@ func main() {
 			},
 		},
 		EnableBashCompletion: true,
-		Description:          "This is a super fast program for encrypting big files. It implements AES 256 with GCM. Because of the parallelism, the file is deleted after an encrypted copy is made. So, be sure to have enough space in the hard drive when performing an encryption or decryption. In addition, no limit has been set for the power of parallelism, you can set the number of goroutines that can go in parallel. If the size of the file is big enough all of them will be loaded in the ram. IMPORTANT: Do not use too high values or you will have a crash.",
+		Description:          "This is a super fast program for encrypting big files, directories and streams. Files are split in chunks sealed in parallel with AES-256-GCM, ChaCha20-Poly1305 or XChaCha20-Poly1305, under a key derived from a password (optionally with a keyfile) or wrapped for X25519 recipients. Every output is written to a temporary file and renamed into place once complete; the source is kept unless --remove-source is given, so have enough space on the disk for both copies. The memory used is bounded by --max-memory (plus up to 256 MiB for the key derivations), --chunks and --files only set how much work is done in parallel within it.",
 		Commands: []*cli.Command{
 			{
 				Name:  "encrypt",
 				Usage: "Encrypt a file",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:     "path",
 						Aliases:  []string{"p"},
-						Usage:    "Path to the file/dir to encrypt",
+						Usage:    "Path to the file/dir to encrypt, '-' to read from stdin",
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Path of the encrypted file or directory where to put it, '-' to write to stdout",
+					},
 					&cli.BoolFlag{
-						Name:    "compress",
-						Aliases: []string{"co"},
-						Usage:   "You can compress the folder before encryption.",
+						Name:  "force",
+						Usage: "Overwrite the output if it already exists",
+					},
+					&cli.BoolFlag{
+						Name:  "remove-source",
+						Usage: "Remove the plaintext once the encrypted file has been written, synced and moved into place",
+					},
+					&cli.BoolFlag{
+						Name:  "resume",
+						Usage: "Keep the output of an interrupted or failed run and continue it on the next run with --resume, checking the chunks already written",
+					},
+					&cli.BoolFlag{
+						Name:  "verify",
+						Usage: "With --remove-source, decrypt the new file and compare it with the plaintext before removing it",
+					},
+					&cli.BoolFlag{
+						Name:    "archive",
+						Aliases: []string{"compress", "co"},
+						Usage:   "Compress the directory (tar + zstd) and encrypt it into a single .ji file. Decryption extracts it back into a directory",
 						Value:   false,
 					},
 					&cli.IntFlag{
@@ -50,38 +138,164 @@ func main() {
 					&cli.IntFlag{
 						Name:    "chunks",
 						Aliases: []string{"c"},
-						Usage:   "Number of chunks to encrypt in parallel. High values can cause a crash. Try at your own risk",
+						Usage:   "Maximum number of chunks processed in parallel, further limited by --max-memory",
 						Value:   encryptor.DefaultGoRoutines,
 					},
+					&cli.IntFlag{
+						Name:  "max-memory",
+						Usage: "Memory budget in MiB for the chunks in flight, shared by the files processed in parallel",
+						Value: int(encryptor.MaxMemory / (1024 * 1024)),
+					},
+					&cli.StringFlag{
+						Name:  "chunk-size",
+						Usage: "Size of the plaintext chunks, from 64KiB to 64MiB (e.g. 256KiB, 4MiB), recorded in the file. Small chunks suit random access and small memories, large ones fast disks",
+						Value: "1MiB",
+					},
+					&cli.StringFlag{
+						Name:  "cipher",
+						Usage: "Cipher of the chunks: aes-256-gcm, chacha20-poly1305 (faster without AES instructions) or xchacha20-poly1305 (random 192-bit nonces, no limit on the data per key)",
+						Value: "aes-256-gcm",
+					},
+					&cli.StringSliceFlag{
+						Name:    "recipient",
+						Aliases: []string{"r"},
+						Usage:   "Encrypt to an X25519 public key from 'ghoji keygen' (or to every one in a file) instead of a password. Repeat it for more recipients, any of them can decrypt",
+					},
+					&cli.StringFlag{
+						Name:  "keyfile",
+						Usage: "File whose hash is mixed with the password: both are needed to decrypt. Leave the password empty to use the keyfile alone. Keep the file unchanged and apart from the password (e.g. on a USB stick)",
+					},
+					&cli.BoolFlag{
+						Name:  "generate-password",
+						Usage: "Generate a random passphrase of diceware words (see --words) instead of asking one, and print it to write it down",
+					},
+					&cli.IntFlag{
+						Name:  "words",
+						Usage: "Number of words of the passphrase from --generate-password, about 12.9 bits each",
+						Value: 6,
+					},
+					&cli.IntFlag{
+						Name:  "min-strength",
+						Usage: "Warn when the password is weaker than this score, from 0 (no check) to 4 as zxcvbn rates it: 3 resists an offline attack on a slow hash, 4 is out of reach",
+						Value: 3,
+					},
+					&cli.BoolFlag{
+						Name:  "refuse-weak",
+						Usage: "Refuse a password weaker than --min-strength instead of warning",
+					},
 					&cli.IntFlag{
 						Name:    "files",
 						Aliases: []string{"f"},
-						Usage:   "Number of files to encrypt in parallel. High values can cause a crash. Try at your own risk",
+						Usage:   "When encrypting a directory, number of files to encrypt in parallel. They share the --max-memory budget (fewer run at once when it has no room for a chunk of each), and wait for their turn to derive their key",
 						Value:   encryptor.DefaultMaxFiles,
 					},
-				},
+					&cli.StringFlag{
+						Name:  "kdf",
+						Usage: "Key derivation function: argon2id or scrypt",
+						Value: "argon2id",
+					},
+					&cli.IntFlag{
+						Name:  "kdf-time",
+						Usage: "KDF time cost: passes for argon2id, parallelization p for scrypt (0 = default)",
+					},
+					&cli.IntFlag{
+						Name:  "kdf-memory",
+						Usage: "KDF memory cost in MiB (0 = default, 64 for argon2id and 128 for scrypt)",
+					},
+					&cli.IntFlag{
+						Name:  "kdf-threads",
+						Usage: "Argon2id parallelism (0 = default)",
+					},
+				}, passwordFlags("", "the password")...),
 				Action: func(c *cli.Context) error {
 					path := c.String("path")
-					numCpu := c.Int("numCpu")
-					chunks := c.Int("chunks")
-					files := c.Int("files")
-					compress := c.Bool("compress")
 
-					graphic.DoEncryption(path, numCpu, chunks, files, compress)
+					kdf, err := encryptor.NewKDFParams(c.String("kdf"), c.Int("kdf-time"), c.Int("kdf-memory"), c.Int("kdf-threads"))
+					if err != nil {
+						return err
+					}
+					chunkSize, err := encryptor.ParseChunkSize(c.String("chunk-size"))
+					if err != nil {
+						return err
+					}
+					suite, err := encryptor.ParseCipher(c.String("cipher"))
+					if err != nil {
+						return err
+					}
+					recipients, err := graphic.ParseRecipients(c.StringSlice("recipient"))
+					if err != nil {
+						return err
+					}
+					keyfile, err := graphic.ParseKeyfile(c.String("keyfile"))
+					if err != nil {
+						return err
+					}
+					password, err := passwordSource(c, "")
+					if err != nil {
+						return err
+					}
+					generate := 0
+					if c.Bool("generate-password") {
+						generate = c.Int("words")
+						if generate < 1 {
+							return fmt.Errorf("--words must be at least 1")
+						}
+					}
 
-					return nil
+					return graphic.DoEncryption(c.Context, path, graphic.Options{
+						Output:        c.String("output"),
+						Force:         c.Bool("force"),
+						RemoveSource:  c.Bool("remove-source"),
+						Verify:        c.Bool("verify"),
+						Resume:        c.Bool("resume"),
+						NumCpu:        c.Int("numCpu"),
+						Chunks:        c.Int("chunks"),
+						MaxMemory:     c.Int("max-memory"),
+						MaxFiles:      c.Int("files"),
+						Archive:       c.Bool("archive"),
+						KDF:           kdf,
+						ChunkSize:     chunkSize,
+						Cipher:        suite,
+						Recipients:    recipients,
+						Keyfile:       keyfile,
+						Password:      password,
+						GenerateWords: generate,
+						MinStrength:   c.Int("min-strength"),
+						RefuseWeak:    c.Bool("refuse-weak"),
+					})
 				},
 			},
 			{
 				Name:  "decrypt",
 				Usage: "Decrypt a file",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:     "path",
 						Aliases:  []string{"p"},
-						Usage:    "Path to the file/dir to decrypt",
+						Usage:    "Path to the file/dir to decrypt, '-' to read from stdin",
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Path of the decrypted file or directory where to put it, '-' to write to stdout. Without it, a file not ending in .ji is decrypted to <name>.decrypted",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Overwrite the output if it already exists",
+					},
+					&cli.BoolFlag{
+						Name:  "remove-source",
+						Usage: "Remove the encrypted file once the plaintext has been written, synced and moved into place",
+					},
+					&cli.BoolFlag{
+						Name:  "resume",
+						Usage: "Keep the output of an interrupted or failed run and continue it on the next run with --resume, checking the chunks already written",
+					},
+					&cli.BoolFlag{
+						Name:  "verify",
+						Usage: "With --remove-source, decrypt the file again and compare it with the written plaintext before removing it",
+					},
 					&cli.IntFlag{
 						Name:    "numCpu",
 						Aliases: []string{"n"},
@@ -91,33 +305,440 @@ func main() {
 					&cli.IntFlag{
 						Name:    "chunks",
 						Aliases: []string{"c"},
-						Usage:   "Number of chunks to encrypt in parallel. High values can cause a crash. Try at your own risk",
+						Usage:   "Maximum number of chunks processed in parallel, further limited by --max-memory",
 						Value:   encryptor.DefaultGoRoutines,
 					},
+					&cli.IntFlag{
+						Name:  "max-memory",
+						Usage: "Memory budget in MiB for the chunks in flight, shared by the files processed in parallel",
+						Value: int(encryptor.MaxMemory / (1024 * 1024)),
+					},
 					&cli.IntFlag{
 						Name:    "files",
 						Aliases: []string{"f"},
-						Usage:   "Number of files to encrypt in parallel. High values can cause a crash. Try at your own risk",
+						Usage:   "When decrypting a directory, number of files to decrypt in parallel. They share the --max-memory budget (fewer run at once when it has no room for a chunk of each), and wait for their turn to derive their key",
 						Value:   encryptor.DefaultMaxFiles,
 					},
-				},
+					&cli.StringSliceFlag{
+						Name:    "identity",
+						Aliases: []string{"i"},
+						Usage:   "Identity file from 'ghoji keygen' opening the files encrypted with --recipient, no password is asked. Repeat it to try more identities",
+					},
+					&cli.StringFlag{
+						Name:  "keyfile",
+						Usage: "Keyfile given at encryption, needed along with the password (leave the password empty if it was used alone)",
+					},
+				}, passwordFlags("", "the password")...),
 				Action: func(c *cli.Context) error {
 					path := c.String("path")
-					numCpu := c.Int("numCpu")
-					chunks := c.Int("chunks")
-					files := c.Int("files")
 
-					graphic.DoDecryption(path, numCpu, chunks, files)
+					identities, err := graphic.ParseIdentities(c.StringSlice("identity"))
+					if err != nil {
+						return err
+					}
+					keyfile, err := graphic.ParseKeyfile(c.String("keyfile"))
+					if err != nil {
+						return err
+					}
+					password, err := passwordSource(c, "")
+					if err != nil {
+						return err
+					}
 
-					return nil
+					return graphic.DoDecryption(c.Context, path, graphic.Options{
+						Output:       c.String("output"),
+						Force:        c.Bool("force"),
+						RemoveSource: c.Bool("remove-source"),
+						Verify:       c.Bool("verify"),
+						Resume:       c.Bool("resume"),
+						NumCpu:       c.Int("numCpu"),
+						Chunks:       c.Int("chunks"),
+						MaxMemory:    c.Int("max-memory"),
+						MaxFiles:     c.Int("files"),
+						Identities:   identities,
+						Keyfile:      keyfile,
+						Password:     password,
+					})
+				},
+			},
+			{
+				Name:  "verify",
+				Usage: "Check that an encrypted file (or every one in a directory) is intact and the password is right, without writing the plaintext",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "path",
+						Aliases:  []string{"p"},
+						Usage:    "Path to the file/dir to verify",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:    "numCpu",
+						Aliases: []string{"n"},
+						Usage:   "Number of CPU cores to use",
+						Value:   encryptor.MaxCPUs,
+					},
+					&cli.IntFlag{
+						Name:    "chunks",
+						Aliases: []string{"c"},
+						Usage:   "Maximum number of chunks processed in parallel, further limited by --max-memory",
+						Value:   encryptor.DefaultGoRoutines,
+					},
+					&cli.IntFlag{
+						Name:  "max-memory",
+						Usage: "Memory budget in MiB for the chunks in flight",
+						Value: int(encryptor.MaxMemory / (1024 * 1024)),
+					},
+					&cli.StringFlag{
+						Name:  "keyfile",
+						Usage: "Keyfile given at encryption, needed along with the password (leave the password empty if it was used alone)",
+					},
+					&cli.StringSliceFlag{
+						Name:    "identity",
+						Aliases: []string{"i"},
+						Usage:   "Identity file from 'ghoji keygen' opening the files encrypted with --recipient, no password is asked. Repeat it to try more identities",
+					},
+				}, passwordFlags("", "the password")...),
+				Action: func(c *cli.Context) error {
+					identities, err := graphic.ParseIdentities(c.StringSlice("identity"))
+					if err != nil {
+						return err
+					}
+					keyfile, err := graphic.ParseKeyfile(c.String("keyfile"))
+					if err != nil {
+						return err
+					}
+					password, err := passwordSource(c, "")
+					if err != nil {
+						return err
+					}
+					return graphic.DoVerify(c.Context, c.String("path"), graphic.Options{
+						NumCpu:     c.Int("numCpu"),
+						Chunks:     c.Int("chunks"),
+						MaxMemory:  c.Int("max-memory"),
+						Identities: identities,
+						Keyfile:    keyfile,
+						Password:   password,
+					})
+				},
+			},
+			{
+				Name:  "info",
+				Usage: "Show the metadata of an encrypted file (or of every one in a directory) without the password",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "path",
+						Aliases:  []string{"p"},
+						Usage:    "Path to the file/dir to inspect",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print JSON on stdout: an object for a file, an array for a directory",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return graphic.DoInfo(c.String("path"), c.Bool("json"))
+				},
+			},
+			{
+				Name:  "cat",
+				Usage: "Decrypt a byte range of an encrypted file to stdout, reading only the chunks that cover it",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "path",
+						Aliases:  []string{"p"},
+						Usage:    "Path to the encrypted file",
+						Required: true,
+					},
+					&cli.Int64Flag{
+						Name:  "offset",
+						Usage: "Offset in the plaintext of the first byte to write",
+					},
+					&cli.Int64Flag{
+						Name:  "length",
+						Usage: "Number of bytes to write, up to the end of the plaintext when negative",
+						Value: -1,
+					},
+					&cli.StringFlag{
+						Name:  "keyfile",
+						Usage: "Keyfile given at encryption, needed along with the password (leave the password empty if it was used alone)",
+					},
+					&cli.StringSliceFlag{
+						Name:    "identity",
+						Aliases: []string{"i"},
+						Usage:   "Identity file from 'ghoji keygen' opening the file encrypted with --recipient, no password is asked. Repeat it to try more identities",
+					},
+				}, passwordFlags("", "the password")...),
+				Action: func(c *cli.Context) error {
+					identities, err := graphic.ParseIdentities(c.StringSlice("identity"))
+					if err != nil {
+						return err
+					}
+					keyfile, err := graphic.ParseKeyfile(c.String("keyfile"))
+					if err != nil {
+						return err
+					}
+					password, err := passwordSource(c, "")
+					if err != nil {
+						return err
+					}
+					return graphic.DoCat(c.Context, c.String("path"), keyfile, password, identities, c.Int64("offset"), c.Int64("length"))
+				},
+			},
+			{
+				Name:  "keygen",
+				Usage: "Generate an X25519 identity to decrypt the files encrypted to its public key with --recipient",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "File where to write the identity, stdout when not set. The public key is printed",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Overwrite the output if it already exists",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return graphic.DoKeygen(c.String("output"), c.Bool("force"))
+				},
+			},
+			{
+				Name:  "rekey",
+				Usage: "Change the password of an encrypted file (or of every one in a directory). Only the header of current files is rewritten, older ones are encrypted again without writing the plaintext to disk",
+				Flags: append(append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "path",
+						Aliases:  []string{"p"},
+						Usage:    "Path to the file/dir to rekey",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "keyfile",
+						Usage: "Keyfile going with the current password",
+					},
+					&cli.StringFlag{
+						Name:  "new-keyfile",
+						Usage: "Keyfile going with the new password, the one of --keyfile when not set. An empty value drops the keyfile",
+					},
+					&cli.StringFlag{
+						Name:  "kdf",
+						Usage: "Key derivation function of the new password: argon2id or scrypt",
+						Value: "argon2id",
+					},
+					&cli.IntFlag{
+						Name:  "kdf-time",
+						Usage: "KDF time cost: passes for argon2id, parallelization p for scrypt (0 = default)",
+					},
+					&cli.IntFlag{
+						Name:  "kdf-memory",
+						Usage: "KDF memory cost in MiB (0 = default, 64 for argon2id and 128 for scrypt)",
+					},
+					&cli.IntFlag{
+						Name:  "kdf-threads",
+						Usage: "Argon2id parallelism (0 = default)",
+					},
+				}, passwordFlags("", "the current password")...), passwordFlags("new-", "the new password")...),
+				Action: func(c *cli.Context) error {
+					kdf, err := encryptor.NewKDFParams(c.String("kdf"), c.Int("kdf-time"), c.Int("kdf-memory"), c.Int("kdf-threads"))
+					if err != nil {
+						return err
+					}
+					keyfile, err := graphic.ParseKeyfile(c.String("keyfile"))
+					if err != nil {
+						return err
+					}
+					newKeyfile := keyfile
+					if c.IsSet("new-keyfile") {
+						newKeyfile, err = graphic.ParseKeyfile(c.String("new-keyfile"))
+						if err != nil {
+							return err
+						}
+					}
+					password, err := passwordSource(c, "")
+					if err != nil {
+						return err
+					}
+					newPassword, err := passwordSource(c, "new-")
+					if err != nil {
+						return err
+					}
+					return graphic.DoRekey(c.Context, c.String("path"), keyfile, password, newKeyfile, newPassword, kdf)
+				},
+			},
+			{
+				Name:  "slot",
+				Usage: "List, add or remove the passwords and public keys that open a file, rewriting only its header",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "List the slots of an encrypted file, no password is needed",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "path",
+								Aliases:  []string{"p"},
+								Usage:    "Path to the encrypted file",
+								Required: true,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							return graphic.DoSlotList(c.String("path"))
+						},
+					},
+					{
+						Name:  "add",
+						Usage: "Add a slot for a new password, or for public keys with --recipient. A current password, or --identity, opens the file",
+						Flags: append(append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "path",
+								Aliases:  []string{"p"},
+								Usage:    "Path to the encrypted file",
+								Required: true,
+							},
+							&cli.StringSliceFlag{
+								Name:    "identity",
+								Aliases: []string{"i"},
+								Usage:   "Identity file opening the file instead of a current password",
+							},
+							&cli.StringSliceFlag{
+								Name:    "recipient",
+								Aliases: []string{"r"},
+								Usage:   "Add a slot for an X25519 public key (or for every one in a file) instead of a new password",
+							},
+							&cli.StringFlag{
+								Name:  "keyfile",
+								Usage: "Keyfile going with the current password",
+							},
+							&cli.StringFlag{
+								Name:  "new-keyfile",
+								Usage: "Keyfile to mix with the new password, both will be needed to open the file with this slot",
+							},
+							&cli.StringFlag{
+								Name:  "kdf",
+								Usage: "Key derivation function of the new password: argon2id or scrypt",
+								Value: "argon2id",
+							},
+							&cli.IntFlag{
+								Name:  "kdf-time",
+								Usage: "KDF time cost: passes for argon2id, parallelization p for scrypt (0 = default)",
+							},
+							&cli.IntFlag{
+								Name:  "kdf-memory",
+								Usage: "KDF memory cost in MiB (0 = default, 64 for argon2id and 128 for scrypt)",
+							},
+							&cli.IntFlag{
+								Name:  "kdf-threads",
+								Usage: "Argon2id parallelism (0 = default)",
+							},
+						}, passwordFlags("", "a current password")...), passwordFlags("new-", "the new password")...),
+						Action: func(c *cli.Context) error {
+							kdf, err := encryptor.NewKDFParams(c.String("kdf"), c.Int("kdf-time"), c.Int("kdf-memory"), c.Int("kdf-threads"))
+							if err != nil {
+								return err
+							}
+							identities, err := graphic.ParseIdentities(c.StringSlice("identity"))
+							if err != nil {
+								return err
+							}
+							recipients, err := graphic.ParseRecipients(c.StringSlice("recipient"))
+							if err != nil {
+								return err
+							}
+							keyfile, err := graphic.ParseKeyfile(c.String("keyfile"))
+							if err != nil {
+								return err
+							}
+							newKeyfile, err := graphic.ParseKeyfile(c.String("new-keyfile"))
+							if err != nil {
+								return err
+							}
+							password, err := passwordSource(c, "")
+							if err != nil {
+								return err
+							}
+							newPassword, err := passwordSource(c, "new-")
+							if err != nil {
+								return err
+							}
+							return graphic.DoSlotAdd(c.Context, c.String("path"), keyfile, password, identities, recipients, newKeyfile, newPassword, kdf)
+						},
+					},
+					{
+						Name:  "remove",
+						Usage: "Remove a slot, as numbered by 'ghoji slot list'. A current password, or --identity, opens the file",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "path",
+								Aliases:  []string{"p"},
+								Usage:    "Path to the encrypted file",
+								Required: true,
+							},
+							&cli.IntFlag{
+								Name:     "slot",
+								Aliases:  []string{"s"},
+								Usage:    "Number of the slot to remove",
+								Required: true,
+							},
+							&cli.StringSliceFlag{
+								Name:    "identity",
+								Aliases: []string{"i"},
+								Usage:   "Identity file opening the file instead of a current password",
+							},
+							&cli.StringFlag{
+								Name:  "keyfile",
+								Usage: "Keyfile going with the current password",
+							},
+						}, passwordFlags("", "a current password")...),
+						Action: func(c *cli.Context) error {
+							identities, err := graphic.ParseIdentities(c.StringSlice("identity"))
+							if err != nil {
+								return err
+							}
+							keyfile, err := graphic.ParseKeyfile(c.String("keyfile"))
+							if err != nil {
+								return err
+							}
+							password, err := passwordSource(c, "")
+							if err != nil {
+								return err
+							}
+							return graphic.DoSlotRemove(c.Context, c.String("path"), keyfile, password, identities, c.Int("slot"))
+						},
+					},
+				},
+			},
+			{
+				Name:  "cleanup",
+				Usage: "Remove the temporary files left by interrupted runs",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "path",
+						Aliases: []string{"p"},
+						Usage:   "Directory to clean, subdirectories included",
+						Value:   ".",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only list the leftovers, without removing them",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return graphic.DoCleanup(c.String("path"), c.Bool("dry-run"))
 				},
 			},
 		},
 	}
 
-	err := app.Run(os.Args)
+	ctx := interruptContext()
+	err := app.RunContext(ctx, os.Args)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	// an interrupted run did not complete, whatever the command returned
+	if ctx.Err() != nil {
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
 		os.Exit(1)
 	}
 }